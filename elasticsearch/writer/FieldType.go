@@ -81,6 +81,11 @@ func GetActionType(conf *config.JSON) ActionType {
 	if actionType == "" || err != nil {
 		actionType = "index"
 	}
+	return ParseActionType(actionType)
+}
+
+// ParseActionType 根据传入的字符串返回对应的ActionType
+func ParseActionType(actionType string) ActionType {
 	actionType = strings.ToUpper(actionType)
 	switch actionType {
 	case "INDEX":
@@ -129,6 +134,24 @@ const (
 	TOKEN_COUNT
 	OBJECT
 	NESTED
+	OP
+	DENSE_VECTOR
+	SPARSE_VECTOR
+	RANK_FEATURES
+	FLATTENED
+	WILDCARD
+	CONSTANT_KEYWORD
+	MATCH_ONLY_TEXT
+	SEARCH_AS_YOU_TYPE
+	SCALED_FLOAT
+	HALF_FLOAT
+	UNSIGNED_LONG
+	// VERSION_FIELD 对应es的version字段类型，配置为type: "version_field"，
+	// type: "version"表示文档的外部版本列，不会生成mapping
+	VERSION_FIELD
+	HISTOGRAM
+	ALIAS
+	JOIN
 )
 
 // String 方法用于返回ElasticSearchFieldType的字符串表示
@@ -192,6 +215,38 @@ func (f ElasticSearchFieldType) String() string {
 		return "OBJECT"
 	case NESTED:
 		return "NESTED"
+	case OP:
+		return "OP"
+	case DENSE_VECTOR:
+		return "DENSE_VECTOR"
+	case SPARSE_VECTOR:
+		return "SPARSE_VECTOR"
+	case RANK_FEATURES:
+		return "RANK_FEATURES"
+	case FLATTENED:
+		return "FLATTENED"
+	case WILDCARD:
+		return "WILDCARD"
+	case CONSTANT_KEYWORD:
+		return "CONSTANT_KEYWORD"
+	case MATCH_ONLY_TEXT:
+		return "MATCH_ONLY_TEXT"
+	case SEARCH_AS_YOU_TYPE:
+		return "SEARCH_AS_YOU_TYPE"
+	case SCALED_FLOAT:
+		return "SCALED_FLOAT"
+	case HALF_FLOAT:
+		return "HALF_FLOAT"
+	case UNSIGNED_LONG:
+		return "UNSIGNED_LONG"
+	case VERSION_FIELD:
+		return "VERSION_FIELD"
+	case HISTOGRAM:
+		return "HISTOGRAM"
+	case ALIAS:
+		return "ALIAS"
+	case JOIN:
+		return "JOIN"
 	default:
 		return "Unknown"
 	}
@@ -259,6 +314,38 @@ func GetESFieldType(typeStr string) ElasticSearchFieldType {
 		return OBJECT
 	case "NESTED":
 		return NESTED
+	case "OP":
+		return OP
+	case "DENSE_VECTOR":
+		return DENSE_VECTOR
+	case "SPARSE_VECTOR":
+		return SPARSE_VECTOR
+	case "RANK_FEATURES":
+		return RANK_FEATURES
+	case "FLATTENED":
+		return FLATTENED
+	case "WILDCARD":
+		return WILDCARD
+	case "CONSTANT_KEYWORD":
+		return CONSTANT_KEYWORD
+	case "MATCH_ONLY_TEXT":
+		return MATCH_ONLY_TEXT
+	case "SEARCH_AS_YOU_TYPE":
+		return SEARCH_AS_YOU_TYPE
+	case "SCALED_FLOAT":
+		return SCALED_FLOAT
+	case "HALF_FLOAT":
+		return HALF_FLOAT
+	case "UNSIGNED_LONG":
+		return UNSIGNED_LONG
+	case "VERSION_FIELD":
+		return VERSION_FIELD
+	case "HISTOGRAM":
+		return HISTOGRAM
+	case "ALIAS":
+		return ALIAS
+	case "JOIN":
+		return JOIN
 	default:
 		return -1 // 或者定义一个新的常量来表示未知类型
 	}
@@ -0,0 +1,116 @@
+package elasticsearch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// batchSizer 自适应的批量大小，bulk返回429或者超时时减半，
+// 延迟低于目标值时逐步增大，范围在[minSize, maxSize]之间
+type batchSizer struct {
+	mu            sync.Mutex
+	size          int64
+	minSize       int64
+	maxSize       int64
+	targetLatency time.Duration
+}
+
+func newBatchSizer(minSize, maxSize int64, targetLatency time.Duration) *batchSizer {
+	if minSize > maxSize {
+		minSize = maxSize
+	}
+	return &batchSizer{
+		size:          maxSize,
+		minSize:       minSize,
+		maxSize:       maxSize,
+		targetLatency: targetLatency,
+	}
+}
+
+func (s *batchSizer) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// observe 根据一次bulk请求的结果调整批量大小
+func (s *batchSizer) observe(latency time.Duration, response *elastic.BulkResponse, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := s.size
+	if isOverloaded(response, err) {
+		s.size = max(s.minSize, s.size/2)
+	} else if err == nil && latency <= s.targetLatency {
+		s.size = min(s.maxSize, s.size+max(1, s.size/10))
+	}
+	if s.size != old {
+		slog.Info(fmt.Sprintf("adaptive batch size changed from %d to %d, latency: %v", old, s.size, latency))
+	}
+}
+
+// isOverloaded 集群返回429或者请求超时说明批量太大了
+func isOverloaded(response *elastic.BulkResponse, err error) bool {
+	if err != nil {
+		var netErr net.Error
+		return elastic.IsStatusCode(err, http.StatusTooManyRequests) ||
+			elastic.IsTimeout(err) ||
+			errors.Is(err, context.DeadlineExceeded) ||
+			(errors.As(err, &netErr) && netErr.Timeout())
+	}
+	if response == nil {
+		return false
+	}
+	for _, m := range response.Items {
+		for _, item := range m {
+			if item.Status == http.StatusTooManyRequests {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// splitBulkItems 按条数和序列化后的字节数把请求拆成多个bulk
+func splitBulkItems(items []bulkItem, maxCount, maxBytes int64) [][]bulkItem {
+	var chunks [][]bulkItem
+	var chunk []bulkItem
+	var chunkBytes int64
+	for _, item := range items {
+		full := maxCount > 0 && int64(len(chunk)) >= maxCount
+		if maxBytes > 0 && len(chunk) > 0 && chunkBytes+item.size > maxBytes {
+			full = true
+		}
+		if full {
+			chunks = append(chunks, chunk)
+			chunk = nil
+			chunkBytes = 0
+		}
+		chunk = append(chunk, item)
+		chunkBytes += item.size
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// requestSize bulk请求序列化后的字节数，每一行后面还有一个换行符
+func requestSize(request elastic.BulkableRequest) (int64, error) {
+	lines, err := request.Source()
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, line := range lines {
+		size += int64(len(line)) + 1
+	}
+	return size, nil
+}
@@ -0,0 +1,82 @@
+package elasticsearch
+
+import (
+	"context"
+	"sync"
+)
+
+// bulkProcessor 有界队列加固定数量的worker并发提交bulk请求，
+// 任一worker失败都会取消上下文，其余worker把队列里的请求丢弃后退出
+type bulkProcessor struct {
+	task   *Task
+	queue  chan []bulkItem
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu  sync.Mutex
+	err error
+}
+
+func newBulkProcessor(ctx context.Context, cancel context.CancelFunc, t *Task) *bulkProcessor {
+	p := &bulkProcessor{
+		task:   t,
+		queue:  make(chan []bulkItem, t.BulkQueueSize),
+		cancel: cancel,
+	}
+	for i := 0; i < int(t.BulkWorkers); i++ {
+		p.wg.Add(1)
+		go p.work(ctx)
+	}
+	return p
+}
+
+func (p *bulkProcessor) work(ctx context.Context) {
+	defer p.wg.Done()
+	for items := range p.queue {
+		if ctx.Err() != nil {
+			// 已经取消了，只需要把队列排空
+			continue
+		}
+		if err := p.task.doBulk(ctx, items); err != nil {
+			p.setErr(err)
+		}
+	}
+}
+
+// Add 把一批请求放入队列，队列满时阻塞，上下文取消时返回错误
+func (p *bulkProcessor) Add(ctx context.Context, items []bulkItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+	select {
+	case p.queue <- items:
+		return nil
+	case <-ctx.Done():
+		if err := p.Err(); err != nil {
+			return err
+		}
+		return ctx.Err()
+	}
+}
+
+// Close 关闭队列并等待所有在途的bulk请求完成
+func (p *bulkProcessor) Close() error {
+	close(p.queue)
+	p.wg.Wait()
+	return p.Err()
+}
+
+func (p *bulkProcessor) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+func (p *bulkProcessor) setErr(err error) {
+	p.mu.Lock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.mu.Unlock()
+	p.cancel()
+}
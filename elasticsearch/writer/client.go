@@ -1,35 +1,198 @@
 package elasticsearch
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net/http"
+	"net/url"
 	"os"
+	"slices"
+	"strings"
 
 	"github.com/as-tool/as-etl-engine/common/config"
 	"github.com/olivere/elastic/v7"
 )
 
-func ES_init(conf *config.JSON) *elastic.Client {
+func ES_init(conf *config.JSON) (*elastic.Client, error) {
 	username := GetUsername(conf)
 	pass := GetPassword(conf)
-	url := GetEndpoint(conf)
-	es, err := elastic.NewClient(elastic.SetURL("http://"+url), elastic.SetBasicAuth(username, pass))
+	endpoints := GetEndpointURLs(conf)
+	if len(endpoints) == 0 {
+		return nil, NewWriterError(BAD_CONFIG_VALUE, "endpoint must be configured", nil)
+	}
+	discovery := IsDiscovery(conf)
+	options := []elastic.ClientOptionFunc{
+		elastic.SetURL(endpoints...),
+		elastic.SetBasicAuth(username, pass),
+		// 只有开启节点发现时才嗅探和健康检查，负载均衡后面的集群需要关闭
+		elastic.SetSniff(discovery),
+		elastic.SetHealthcheck(discovery),
+	}
+	if discovery {
+		options = append(options, elastic.SetSnifferCallback(newDiscoveryFilter(GetDiscoveryFilter(conf))))
+	}
+	if u, err := url.Parse(endpoints[0]); err == nil {
+		// 嗅探到的节点地址沿用endpoint的协议
+		options = append(options, elastic.SetScheme(u.Scheme))
+	}
+	tlsConfig, err := newTLSConfig(conf)
+	if err != nil {
+		return nil, NewWriterError(BAD_CONFIG_VALUE, "invalid tls config", err)
+	}
+	params, err := GetBulkUrlParams(conf)
+	if err != nil {
+		return nil, err
+	}
+	requireAlias, hasRequireAlias := params["require_alias"]
+	if tlsConfig != nil || hasRequireAlias {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if tlsConfig != nil {
+			transport.TLSClientConfig = tlsConfig
+		}
+		var roundTripper http.RoundTripper = transport
+		if hasRequireAlias {
+			roundTripper = &bulkParamsTransport{
+				base:   transport,
+				params: url.Values{"require_alias": []string{requireAlias}},
+			}
+		}
+		options = append(options, elastic.SetHttpClient(&http.Client{Transport: roundTripper}))
+	}
+	es, err := elastic.NewClient(options...)
 	if err != nil {
-		msg := fmt.Sprintf("Error creating the client: %s", err)
-		fmt.Println(msg)
-		slog.Error(msg)
-		os.Exit(1)
+		message := fmt.Sprintf("Error creating the client for %v", endpoints)
+		slog.Error(fmt.Sprintf("%s: %s", message, err))
+		return nil, NewWriterError(CLUSTER_UNREACHABLE, message, err)
 	}
+	return es, nil
+}
 
-	return es
+// GetEndpointURLs endpoint没有指定协议时默认使用http
+func GetEndpointURLs(conf *config.JSON) []string {
+	var urls []string
+	for _, endpoint := range GetEndpoints(conf) {
+		if strings.HasPrefix(endpoint, "http://") || strings.HasPrefix(endpoint, "https://") {
+			urls = append(urls, endpoint)
+		} else {
+			urls = append(urls, "http://"+endpoint)
+		}
+	}
+	return urls
+}
+
+// newDiscoveryFilter 按discoveryFilter过滤嗅探到的节点，
+// 格式为逗号分隔的key:value，key可以是name、host、ip、role或者节点的自定义属性，_all表示所有节点
+func newDiscoveryFilter(filter string) elastic.SnifferCallback {
+	return func(node *elastic.NodesInfoNode) bool {
+		if filter == "" || filter == "_all" {
+			return true
+		}
+		for _, cond := range strings.Split(filter, ",") {
+			kv := strings.SplitN(strings.TrimSpace(cond), ":", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			key, value := kv[0], kv[1]
+			switch key {
+			case "name":
+				if node.Name == value {
+					return true
+				}
+			case "host":
+				if node.Host == value {
+					return true
+				}
+			case "ip":
+				if node.IP == value {
+					return true
+				}
+			case "role":
+				if slices.Contains(node.Roles, value) {
+					return true
+				}
+			default:
+				if node.Attributes[key] == value {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+// newTLSConfig 根据ca证书、客户端证书等配置生成tls配置，都没有配置时返回nil
+func newTLSConfig(conf *config.JSON) (*tls.Config, error) {
+	caCert := GetCACert(conf)
+	clientCert := GetClientCert(conf)
+	clientKey := GetClientKey(conf)
+	serverName := GetServerName(conf)
+	insecureSkipVerify := IsInsecureSkipVerify(conf)
+	if caCert == "" && clientCert == "" && serverName == "" && !insecureSkipVerify {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+	if caCert != "" {
+		pem, err := os.ReadFile(caCert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			message := fmt.Sprintf("no valid certificate found in caCert %s", caCert)
+			return nil, errors.New(message)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if clientCert != "" || clientKey != "" {
+		if clientCert == "" || clientKey == "" {
+			return nil, errors.New("clientCert and clientKey must be configured together")
+		}
+		cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
 }
 
 func ES_Version(client *elastic.Client, conf *config.JSON) string {
-	url := GetEndpoint(conf)
-	es_version, _ := client.ElasticsearchVersion("http://" + url)
+	var es_version string
+	for _, endpoint := range GetEndpointURLs(conf) {
+		v, err := client.ElasticsearchVersion(endpoint)
+		if err == nil {
+			es_version = v
+			break
+		}
+	}
 	return es_version
 }
 
 func ES_close() {
 
 }
+
+// bulkParamsTransport 给_bulk请求追加BulkService不支持的url参数
+type bulkParamsTransport struct {
+	base   http.RoundTripper
+	params url.Values
+}
+
+func (t *bulkParamsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if strings.HasSuffix(req.URL.Path, "/_bulk") {
+		req = req.Clone(req.Context())
+		query := req.URL.Query()
+		for k, v := range t.params {
+			query[k] = v
+		}
+		req.URL.RawQuery = query.Encode()
+	}
+	return t.base.RoundTrip(req)
+}
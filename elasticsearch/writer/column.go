@@ -5,8 +5,12 @@ type EsColumn struct {
 	Type                        string
 	Timezone                    string
 	Format                      string
+	SrcFormat                   []string
+	GeoFormat                   string
+	Dims                        int
 	DstFormat                   string
 	Array                       bool
+	ArrayFormat                 string
 	DstArray                    bool
 	JsonArray                   bool
 	Origin                      bool
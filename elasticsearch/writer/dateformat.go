@@ -0,0 +1,160 @@
+package elasticsearch
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	EPOCH_MILLIS = "epoch_millis"
+	EPOCH_SECOND = "epoch_second"
+)
+
+// defaultSrcFormats 没有配置srcFormat时尝试的输入格式，第一个是之前版本固定使用的格式
+var defaultSrcFormats = []string{"2006/01/02 15:04:05", time.RFC3339Nano, "2006-01-02 15:04:05", "2006-01-02"}
+
+// toGoLayout 把java/joda风格的日期格式转换成go的layout，已经是go layout的原样返回
+func toGoLayout(pattern string) string {
+	if pattern == EPOCH_MILLIS || pattern == EPOCH_SECOND {
+		return pattern
+	}
+	if strings.Contains(pattern, "2006") || strings.Contains(pattern, "15:04") {
+		return pattern
+	}
+	var layout strings.Builder
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		// 单引号中的内容是字面量，两个单引号表示单引号本身
+		if c == '\'' {
+			end := i + 1
+			for end < len(runes) && runes[end] != '\'' {
+				end++
+			}
+			if end == i+1 {
+				layout.WriteRune('\'')
+			} else {
+				layout.WriteString(string(runes[i+1 : end]))
+			}
+			i = end + 1
+			continue
+		}
+		n := 1
+		for i+n < len(runes) && runes[i+n] == c {
+			n++
+		}
+		i += n
+		layout.WriteString(jodaToken(c, n))
+	}
+	return layout.String()
+}
+
+func jodaToken(c rune, n int) string {
+	switch c {
+	case 'y', 'u':
+		if n == 2 {
+			return "06"
+		}
+		return "2006"
+	case 'M':
+		switch n {
+		case 1:
+			return "1"
+		case 2:
+			return "01"
+		case 3:
+			return "Jan"
+		default:
+			return "January"
+		}
+	case 'd':
+		if n == 1 {
+			return "2"
+		}
+		return "02"
+	case 'D':
+		return "002"
+	case 'H', 'k':
+		return "15"
+	case 'h', 'K':
+		if n == 1 {
+			return "3"
+		}
+		return "03"
+	case 'm':
+		if n == 1 {
+			return "4"
+		}
+		return "04"
+	case 's':
+		if n == 1 {
+			return "5"
+		}
+		return "05"
+	case 'S':
+		return strings.Repeat("0", n)
+	case 'a':
+		return "PM"
+	case 'E':
+		if n <= 3 {
+			return "Mon"
+		}
+		return "Monday"
+	case 'Z':
+		if n == 1 {
+			return "-0700"
+		}
+		return "-07:00"
+	case 'X':
+		switch n {
+		case 1:
+			return "Z07"
+		case 2:
+			return "Z0700"
+		default:
+			return "Z07:00"
+		}
+	case 'z':
+		return "MST"
+	default:
+		return strings.Repeat(string(c), n)
+	}
+}
+
+// parseDate 依次用layouts解析日期，不带时区的日期按loc解析
+func parseDate(v string, layouts []string, loc *time.Location) (time.Time, error) {
+	v = strings.TrimSpace(v)
+	for _, layout := range layouts {
+		switch layout {
+		case EPOCH_MILLIS:
+			if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+				return time.UnixMilli(ms).In(loc), nil
+			}
+		case EPOCH_SECOND:
+			if s, err := strconv.ParseFloat(v, 64); err == nil {
+				return time.UnixMilli(int64(s * 1000)).In(loc), nil
+			}
+		default:
+			if date, err := time.ParseInLocation(layout, v, loc); err == nil {
+				return date, nil
+			}
+		}
+	}
+	return time.Time{}, fmt.Errorf("date %q does not match any of formats %v", v, layouts)
+}
+
+// formatDate 按layout输出日期，没有配置时输出带时区偏移的RFC3339
+func formatDate(date time.Time, layout string) string {
+	switch layout {
+	case "":
+		return date.Format(time.RFC3339Nano)
+	case EPOCH_MILLIS:
+		return strconv.FormatInt(date.UnixMilli(), 10)
+	case EPOCH_SECOND:
+		return strconv.FormatInt(date.Unix(), 10)
+	default:
+		return date.Format(layout)
+	}
+}
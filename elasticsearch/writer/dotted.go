@@ -0,0 +1,71 @@
+package elasticsearch
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// expandDottedFields 把customer.address.city这样带点的字段展开成嵌套的对象
+func expandDottedFields(data map[string]interface{}) (map[string]interface{}, error) {
+	result := make(map[string]interface{}, len(data))
+	for _, key := range sortedKeys(data) {
+		names := strings.Split(key, ".")
+		current := result
+		for _, name := range names[:len(names)-1] {
+			child, ok := current[name]
+			if !ok || child == nil {
+				child = make(map[string]interface{})
+				current[name] = child
+			}
+			childMap, ok := child.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("field %s conflicts with non-object field %s", key, name)
+			}
+			current = childMap
+		}
+		// 按字典序处理，父字段总是先于子字段写入
+		current[names[len(names)-1]] = data[key]
+	}
+	return result, nil
+}
+
+// expandDottedProperties 把带点的字段mapping展开成object字段的properties
+func expandDottedProperties(properties map[string]interface{}) (map[string]interface{}, error) {
+	result := make(map[string]interface{}, len(properties))
+	for _, key := range sortedKeys(properties) {
+		names := strings.Split(key, ".")
+		current := result
+		for _, name := range names[:len(names)-1] {
+			parent, ok := current[name].(map[string]interface{})
+			if !ok {
+				parent = make(map[string]interface{})
+				current[name] = parent
+			}
+			if t, ok := parent["type"].(string); ok && !isObjectType(t) {
+				return nil, fmt.Errorf("column %s conflicts with column %s of type %s", key, name, t)
+			}
+			props, ok := parent["properties"].(map[string]interface{})
+			if !ok {
+				props = make(map[string]interface{})
+				parent["properties"] = props
+			}
+			current = props
+		}
+		current[names[len(names)-1]] = properties[key]
+	}
+	return result, nil
+}
+
+func isObjectType(t string) bool {
+	return strings.EqualFold(t, OBJECT.String()) || strings.EqualFold(t, NESTED.String())
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
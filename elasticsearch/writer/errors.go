@@ -0,0 +1,80 @@
+package elasticsearch
+
+import "fmt"
+
+// 定义ErrorCode常量
+const (
+	BAD_CONFIG_VALUE ErrorCode = iota
+	UNSUPPORTED_TYPE
+	CLUSTER_UNREACHABLE
+	ES_INDEX_CREATE
+	ES_INDEX_DELETE
+	ES_MAPPINGS
+	ES_ALIAS_MODIFY
+	ES_DELETE_BY_QUERY
+	ES_SETTINGS_UPDATE
+	ES_FORCE_MERGE
+	ES_WRITE_REJECTED
+	RECORD_PARSE
+)
+
+// ErrorCode es writer的错误码
+type ErrorCode int
+
+// String方法返回ErrorCode的字符串表示
+func (c ErrorCode) String() string {
+	switch c {
+	case BAD_CONFIG_VALUE:
+		return "BAD_CONFIG_VALUE"
+	case UNSUPPORTED_TYPE:
+		return "UNSUPPORTED_TYPE"
+	case CLUSTER_UNREACHABLE:
+		return "CLUSTER_UNREACHABLE"
+	case ES_INDEX_CREATE:
+		return "ES_INDEX_CREATE"
+	case ES_INDEX_DELETE:
+		return "ES_INDEX_DELETE"
+	case ES_MAPPINGS:
+		return "ES_MAPPINGS"
+	case ES_ALIAS_MODIFY:
+		return "ES_ALIAS_MODIFY"
+	case ES_DELETE_BY_QUERY:
+		return "ES_DELETE_BY_QUERY"
+	case ES_SETTINGS_UPDATE:
+		return "ES_SETTINGS_UPDATE"
+	case ES_FORCE_MERGE:
+		return "ES_FORCE_MERGE"
+	case ES_WRITE_REJECTED:
+		return "ES_WRITE_REJECTED"
+	case RECORD_PARSE:
+		return "RECORD_PARSE"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// WriterError 带错误码的错误，可以用errors.As取出错误码
+type WriterError struct {
+	Code    ErrorCode
+	Message string
+	Err     error
+}
+
+func NewWriterError(code ErrorCode, message string, err error) *WriterError {
+	return &WriterError{
+		Code:    code,
+		Message: message,
+		Err:     err,
+	}
+}
+
+func (e *WriterError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("[%s] %s: %v", e.Code, e.Message, e.Err)
+	}
+	return fmt.Sprintf("[%s] %s", e.Code, e.Message)
+}
+
+func (e *WriterError) Unwrap() error {
+	return e.Err
+}
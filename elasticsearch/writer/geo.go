@@ -0,0 +1,637 @@
+package elasticsearch
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/as-tool/as-etl-engine/common/element"
+)
+
+// geo_point的输入格式
+const (
+	// GEO_FORMAT_LAT_LON "lat,lon"格式
+	GEO_FORMAT_LAT_LON = "lat_lon"
+	// GEO_FORMAT_LON_LAT "lon lat"或"lon,lat"格式
+	GEO_FORMAT_LON_LAT = "lon_lat"
+	// GEO_FORMAT_WKT POINT(lon lat)格式
+	GEO_FORMAT_WKT = "wkt"
+	// GEO_FORMAT_GEOHASH geohash格式
+	GEO_FORMAT_GEOHASH = "geohash"
+	// GEO_FORMAT_LAT 纬度单独一列，和同名的经度列合并成一个字段
+	GEO_FORMAT_LAT = "lat"
+	// GEO_FORMAT_LON 经度单独一列，和同名的纬度列合并成一个字段
+	GEO_FORMAT_LON = "lon"
+)
+
+var geoFormats = []string{GEO_FORMAT_LAT_LON, GEO_FORMAT_LON_LAT, GEO_FORMAT_WKT, GEO_FORMAT_GEOHASH, GEO_FORMAT_LAT, GEO_FORMAT_LON}
+
+// geoPointPart 经度或纬度单独一列时转换的结果
+type geoPointPart struct {
+	key   string
+	value float64
+}
+
+// convertGeoPoint 按geoFormat把geo_point列转换成{"lat":..,"lon":..}，没有配置geoFormat时原样写入
+func convertGeoPoint(esColumn EsColumn, column element.Column) (interface{}, error) {
+	if esColumn.GeoFormat == GEO_FORMAT_LAT || esColumn.GeoFormat == GEO_FORMAT_LON {
+		v, err := column.AsFloat64()
+		if err != nil {
+			return nil, err
+		}
+		limit := 90.0
+		if esColumn.GeoFormat == GEO_FORMAT_LON {
+			limit = 180
+		}
+		if v < -limit || v > limit {
+			return nil, fmt.Errorf("geo_point %s %v out of range", esColumn.GeoFormat, v)
+		}
+		return geoPointPart{key: esColumn.GeoFormat, value: v}, nil
+	}
+	v, err := column.AsString()
+	if err != nil {
+		return nil, err
+	}
+	v = strings.TrimSpace(v)
+	var lat, lon float64
+	switch esColumn.GeoFormat {
+	case "":
+		return v, nil
+	case GEO_FORMAT_LAT_LON:
+		lat, lon, err = parseCoordinatePair(v, false)
+	case GEO_FORMAT_LON_LAT:
+		lat, lon, err = parseCoordinatePair(v, true)
+	case GEO_FORMAT_WKT:
+		var geometry map[string]interface{}
+		geometry, err = parseWKT(v)
+		if err != nil {
+			return nil, err
+		}
+		point, ok := geometry["coordinates"].([]float64)
+		if geometry["type"] != "Point" || !ok {
+			return nil, fmt.Errorf("geo_point %q must be a WKT POINT", v)
+		}
+		lon, lat = point[0], point[1]
+	case GEO_FORMAT_GEOHASH:
+		lat, lon, err = decodeGeohash(v)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return nil, fmt.Errorf("geo_point %q out of range", v)
+	}
+	return map[string]interface{}{"lat": lat, "lon": lon}, nil
+}
+
+// mergeGeoPointPart 把经度或纬度合并到同名的geo_point字段中
+func mergeGeoPointPart(data map[string]interface{}, name string, part geoPointPart) {
+	point, ok := data[name].(map[string]interface{})
+	if !ok {
+		point = make(map[string]interface{}, 2)
+		data[name] = point
+	}
+	point[part.key] = part.value
+}
+
+func isGeoPointPart(esColumn EsColumn) bool {
+	return esColumn.GeoFormat == GEO_FORMAT_LAT || esColumn.GeoFormat == GEO_FORMAT_LON
+}
+
+// checkMergedGeoPoints 检查经纬度分开的geo_point是否同时有lat和lon，只有一半时es会拒绝整个文档
+// 两列都是null时和null列一样处理
+func checkMergedGeoPoints(columns []EsColumn, data map[string]interface{}, writeNull bool) error {
+	for _, column := range columns {
+		if column.GeoFormat != GEO_FORMAT_LAT {
+			continue
+		}
+		point, ok := data[column.Name].(map[string]interface{})
+		if !ok {
+			if writeNull {
+				data[column.Name] = nil
+			}
+			continue
+		}
+		if len(point) != 2 {
+			return fmt.Errorf("geo_point %s must have both lat and lon, got %v", column.Name, point)
+		}
+	}
+	return nil
+}
+
+// checkGeoPointParts 检查经度和纬度分开的列是否成对出现在同名的geo_point字段中
+func checkGeoPointParts(columns []EsColumn) error {
+	parts := make(map[string][]string)
+	var names []string
+	for _, column := range columns {
+		if !isGeoPointPart(column) {
+			continue
+		}
+		if _, ok := parts[column.Name]; !ok {
+			names = append(names, column.Name)
+		}
+		parts[column.Name] = append(parts[column.Name], column.GeoFormat)
+	}
+	for _, name := range names {
+		formats := parts[name]
+		if len(formats) != 2 || formats[0] == formats[1] {
+			return fmt.Errorf("geo_point column %s must have exactly one lat and one lon column, got %v", name, formats)
+		}
+	}
+	for _, column := range columns {
+		if _, ok := parts[column.Name]; ok && !isGeoPointPart(column) {
+			return fmt.Errorf("column %s is already a geo_point with separate lat and lon columns", column.Name)
+		}
+	}
+	return nil
+}
+
+// parseCoordinatePair 解析逗号或空格分隔的两个坐标
+func parseCoordinatePair(v string, lonFirst bool) (lat float64, lon float64, err error) {
+	parts := strings.FieldsFunc(v, func(r rune) bool { return r == ',' || unicode.IsSpace(r) })
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("geo_point %q must have two coordinates", v)
+	}
+	first, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	second, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	if lonFirst {
+		return second, first, nil
+	}
+	return first, second, nil
+}
+
+const geohashBase32 = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// decodeGeohash 返回geohash所表示区域的中心点
+func decodeGeohash(hash string) (lat float64, lon float64, err error) {
+	if hash == "" {
+		return 0, 0, errors.New("empty geohash")
+	}
+	latRange := [2]float64{-90, 90}
+	lonRange := [2]float64{-180, 180}
+	even := true
+	for _, c := range strings.ToLower(hash) {
+		idx := strings.IndexRune(geohashBase32, c)
+		if idx < 0 {
+			return 0, 0, fmt.Errorf("invalid geohash %q", hash)
+		}
+		for bit := 4; bit >= 0; bit-- {
+			r := &latRange
+			if even {
+				r = &lonRange
+			}
+			mid := (r[0] + r[1]) / 2
+			if idx>>bit&1 == 1 {
+				r[0] = mid
+			} else {
+				r[1] = mid
+			}
+			even = !even
+		}
+	}
+	return (latRange[0] + latRange[1]) / 2, (lonRange[0] + lonRange[1]) / 2, nil
+}
+
+// convertGeoShape 把geo_shape列转换成GeoJSON，支持GeoJSON、WKT、WKB和mysql GEOMETRY列的内部格式
+func convertGeoShape(esColumn EsColumn, column element.Column) (interface{}, error) {
+	if column.Type() == element.TypeBytes {
+		b, err := column.AsBytes()
+		if err != nil {
+			return nil, err
+		}
+		if len(b) == 0 {
+			return nil, nil
+		}
+		return parseWKBGeometry(b)
+	}
+	v, err := column.AsString()
+	if err != nil {
+		return nil, err
+	}
+	v = strings.TrimSpace(v)
+	switch {
+	case v == "":
+		return nil, nil
+	case strings.HasPrefix(v, "{"):
+		return parseJSONColumn(esColumn, GEO_SHAPE.String(), v)
+	case isHexWKB(v):
+		b, _ := hex.DecodeString(strings.TrimPrefix(strings.ToLower(v), "0x"))
+		return parseWKBGeometry(b)
+	default:
+		return parseWKT(v)
+	}
+}
+
+func isHexWKB(v string) bool {
+	v = strings.TrimPrefix(strings.ToLower(v), "0x")
+	if len(v) < 10 || len(v)%2 != 0 {
+		return false
+	}
+	for _, c := range v {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// wktTypes WKT类型和GeoJSON类型的对应关系
+var wktTypes = map[string]string{
+	"POINT":              "Point",
+	"LINESTRING":         "LineString",
+	"POLYGON":            "Polygon",
+	"MULTIPOINT":         "MultiPoint",
+	"MULTILINESTRING":    "MultiLineString",
+	"MULTIPOLYGON":       "MultiPolygon",
+	"GEOMETRYCOLLECTION": "GeometryCollection",
+}
+
+// parseWKT 把WKT转换成GeoJSON，忽略Z和M坐标
+func parseWKT(v string) (map[string]interface{}, error) {
+	// 去掉EWKT的SRID=4326;前缀
+	if i := strings.Index(v, ";"); i >= 0 && strings.HasPrefix(strings.ToUpper(v), "SRID=") {
+		v = v[i+1:]
+	}
+	p := &wktParser{input: v}
+	geometry, err := p.parseGeometry()
+	if err != nil {
+		return nil, fmt.Errorf("invalid WKT %q: %w", v, err)
+	}
+	p.skipSpace()
+	if p.pos < len(p.input) {
+		return nil, fmt.Errorf("invalid WKT %q: unexpected %q", v, p.input[p.pos:])
+	}
+	return geometry, nil
+}
+
+type wktParser struct {
+	input string
+	pos   int
+}
+
+func (p *wktParser) skipSpace() {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *wktParser) word() string {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.input) && unicode.IsLetter(rune(p.input[p.pos])) {
+		p.pos++
+	}
+	return strings.ToUpper(p.input[start:p.pos])
+}
+
+func (p *wktParser) expect(c byte) error {
+	p.skipSpace()
+	if p.pos >= len(p.input) || p.input[p.pos] != c {
+		return fmt.Errorf("expect %q at %d", c, p.pos)
+	}
+	p.pos++
+	return nil
+}
+
+// next 下一个字符是c时跳过并返回true
+func (p *wktParser) next(c byte) bool {
+	p.skipSpace()
+	if p.pos < len(p.input) && p.input[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *wktParser) parseGeometry() (map[string]interface{}, error) {
+	name := p.word()
+	geoType, ok := wktTypes[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported geometry type %q", name)
+	}
+	// 跳过Z、M、ZM维度标记
+	save := p.pos
+	if dim := p.word(); dim != "Z" && dim != "M" && dim != "ZM" {
+		p.pos = save
+	}
+	save = p.pos
+	if p.word() == "EMPTY" {
+		return nil, fmt.Errorf("empty %s", name)
+	}
+	p.pos = save
+
+	if geoType == "GeometryCollection" {
+		if err := p.expect('('); err != nil {
+			return nil, err
+		}
+		geometries := make([]interface{}, 0)
+		for {
+			g, err := p.parseGeometry()
+			if err != nil {
+				return nil, err
+			}
+			geometries = append(geometries, g)
+			if !p.next(',') {
+				break
+			}
+		}
+		if err := p.expect(')'); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"type": geoType, "geometries": geometries}, nil
+	}
+
+	var coordinates interface{}
+	var err error
+	switch geoType {
+	case "Point":
+		if err = p.expect('('); err != nil {
+			return nil, err
+		}
+		coordinates, err = p.parsePoint()
+		if err == nil {
+			err = p.expect(')')
+		}
+	case "LineString":
+		coordinates, err = p.parsePoints()
+	case "MultiPoint":
+		coordinates, err = p.parseMultiPoint()
+	case "Polygon", "MultiLineString":
+		coordinates, err = p.parseList(p.parsePoints)
+	case "MultiPolygon":
+		coordinates, err = p.parseList(func() (interface{}, error) { return p.parseList(p.parsePoints) })
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"type": geoType, "coordinates": coordinates}, nil
+}
+
+func (p *wktParser) parsePoint() ([]float64, error) {
+	point := make([]float64, 0, 2)
+	for {
+		p.skipSpace()
+		start := p.pos
+		for p.pos < len(p.input) && strings.ContainsRune("+-.0123456789eE", rune(p.input[p.pos])) {
+			p.pos++
+		}
+		if start == p.pos {
+			break
+		}
+		f, err := strconv.ParseFloat(p.input[start:p.pos], 64)
+		if err != nil {
+			return nil, err
+		}
+		point = append(point, f)
+	}
+	if len(point) < 2 {
+		return nil, fmt.Errorf("point needs at least two coordinates at %d", p.pos)
+	}
+	return point[:2], nil
+}
+
+// parsePoints 解析(x y, x y, ...)
+func (p *wktParser) parsePoints() (interface{}, error) {
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+	points := make([][]float64, 0)
+	for {
+		point, err := p.parsePoint()
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, point)
+		if !p.next(',') {
+			break
+		}
+	}
+	return points, p.expect(')')
+}
+
+// parseMultiPoint 同时支持MULTIPOINT(1 2, 3 4)和MULTIPOINT((1 2), (3 4))
+func (p *wktParser) parseMultiPoint() (interface{}, error) {
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+	points := make([][]float64, 0)
+	for {
+		wrapped := p.next('(')
+		point, err := p.parsePoint()
+		if err != nil {
+			return nil, err
+		}
+		if wrapped {
+			if err = p.expect(')'); err != nil {
+				return nil, err
+			}
+		}
+		points = append(points, point)
+		if !p.next(',') {
+			break
+		}
+	}
+	return points, p.expect(')')
+}
+
+func (p *wktParser) parseList(item func() (interface{}, error)) (interface{}, error) {
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+	list := make([]interface{}, 0)
+	for {
+		v, err := item()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+		if !p.next(',') {
+			break
+		}
+	}
+	return list, p.expect(')')
+}
+
+// parseWKBGeometry 解析WKB，mysql GEOMETRY列的内部格式是4字节SRID加WKB
+func parseWKBGeometry(b []byte) (map[string]interface{}, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+	r := &wkbReader{data: b}
+	geometry, err := r.readGeometry()
+	if err == nil && r.pos == len(b) {
+		return geometry, nil
+	}
+	if len(b) > 4 {
+		r = &wkbReader{data: b[4:]}
+		if geometry, err = r.readGeometry(); err == nil && r.pos == len(r.data) {
+			return geometry, nil
+		}
+	}
+	if err == nil {
+		err = errors.New("unexpected trailing bytes")
+	}
+	return nil, fmt.Errorf("invalid WKB: %w", err)
+}
+
+type wkbReader struct {
+	data  []byte
+	pos   int
+	order binary.ByteOrder
+}
+
+var errWKBTooShort = errors.New("WKB too short")
+
+func (r *wkbReader) readUint32() (uint32, error) {
+	if r.pos+4 > len(r.data) {
+		return 0, errWKBTooShort
+	}
+	v := r.order.Uint32(r.data[r.pos:])
+	r.pos += 4
+	return v, nil
+}
+
+func (r *wkbReader) readPoint(dims int) ([]float64, error) {
+	if r.pos+8*dims > len(r.data) {
+		return nil, errWKBTooShort
+	}
+	point := make([]float64, dims)
+	for i := range point {
+		point[i] = math.Float64frombits(r.order.Uint64(r.data[r.pos:]))
+		r.pos += 8
+	}
+	return point[:2], nil
+}
+
+func (r *wkbReader) readPoints(dims int) ([][]float64, error) {
+	n, err := r.readUint32()
+	if err != nil {
+		return nil, err
+	}
+	if int(n) > (len(r.data)-r.pos)/(8*dims) {
+		return nil, errWKBTooShort
+	}
+	points := make([][]float64, 0, n)
+	for i := uint32(0); i < n; i++ {
+		point, err := r.readPoint(dims)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, point)
+	}
+	return points, nil
+}
+
+func (r *wkbReader) readGeometry() (map[string]interface{}, error) {
+	if r.pos >= len(r.data) {
+		return nil, errWKBTooShort
+	}
+	switch r.data[r.pos] {
+	case 0:
+		r.order = binary.BigEndian
+	case 1:
+		r.order = binary.LittleEndian
+	default:
+		return nil, fmt.Errorf("invalid byte order %d", r.data[r.pos])
+	}
+	r.pos++
+	wkbType, err := r.readUint32()
+	if err != nil {
+		return nil, err
+	}
+	// EWKB用高位表示Z、M和SRID，ISO WKB用千位表示维度
+	dims := 2
+	if wkbType&0x80000000 != 0 {
+		dims++
+	}
+	if wkbType&0x40000000 != 0 {
+		dims++
+	}
+	if wkbType&0x20000000 != 0 {
+		if _, err = r.readUint32(); err != nil {
+			return nil, err
+		}
+	}
+	wkbType &= 0x0fffffff
+	switch wkbType / 1000 {
+	case 1, 2:
+		dims++
+	case 3:
+		dims += 2
+	}
+	wkbType %= 1000
+
+	var coordinates interface{}
+	switch wkbType {
+	case 1:
+		point, err := r.readPoint(dims)
+		if err != nil {
+			return nil, err
+		}
+		if math.IsNaN(point[0]) {
+			return nil, errors.New("empty point")
+		}
+		return map[string]interface{}{"type": "Point", "coordinates": point}, nil
+	case 2:
+		coordinates, err = r.readPoints(dims)
+		return map[string]interface{}{"type": "LineString", "coordinates": coordinates}, err
+	case 3:
+		n, err := r.readUint32()
+		if err != nil {
+			return nil, err
+		}
+		rings := make([]interface{}, 0)
+		for i := uint32(0); i < n; i++ {
+			ring, err := r.readPoints(dims)
+			if err != nil {
+				return nil, err
+			}
+			rings = append(rings, ring)
+		}
+		return map[string]interface{}{"type": "Polygon", "coordinates": rings}, nil
+	case 4, 5, 6, 7:
+		n, err := r.readUint32()
+		if err != nil {
+			return nil, err
+		}
+		members := make([]map[string]interface{}, 0)
+		for i := uint32(0); i < n; i++ {
+			// 每个子几何对象都有自己的字节序
+			member, err := r.readGeometry()
+			if err != nil {
+				return nil, err
+			}
+			members = append(members, member)
+		}
+		return multiGeometry(wkbType, members), nil
+	default:
+		return nil, fmt.Errorf("unsupported WKB type %d", wkbType)
+	}
+}
+
+func multiGeometry(wkbType uint32, members []map[string]interface{}) map[string]interface{} {
+	if wkbType == 7 {
+		geometries := make([]interface{}, 0, len(members))
+		for _, m := range members {
+			geometries = append(geometries, m)
+		}
+		return map[string]interface{}{"type": "GeometryCollection", "geometries": geometries}
+	}
+	geoType := map[uint32]string{4: "MultiPoint", 5: "MultiLineString", 6: "MultiPolygon"}[wkbType]
+	coordinates := make([]interface{}, 0, len(members))
+	for _, m := range members {
+		coordinates = append(coordinates, m["coordinates"])
+	}
+	return map[string]interface{}{"type": geoType, "coordinates": coordinates}
+}
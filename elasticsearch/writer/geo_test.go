@@ -0,0 +1,308 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/as-tool/as-etl-engine/common/element"
+)
+
+// wkb 按字节序拼接WKB，order为0时大端，为1时小端
+type wkb struct {
+	buf   bytes.Buffer
+	order binary.ByteOrder
+}
+
+func newWKB(order byte, wkbType uint32) *wkb {
+	w := &wkb{order: binary.LittleEndian}
+	if order == 0 {
+		w.order = binary.BigEndian
+	}
+	w.buf.WriteByte(order)
+	return w.uint32(wkbType)
+}
+
+func (w *wkb) uint32(v uint32) *wkb {
+	binary.Write(&w.buf, w.order, v)
+	return w
+}
+
+func (w *wkb) floats(vs ...float64) *wkb {
+	for _, v := range vs {
+		binary.Write(&w.buf, w.order, v)
+	}
+	return w
+}
+
+func (w *wkb) raw(b []byte) *wkb {
+	w.buf.Write(b)
+	return w
+}
+
+func (w *wkb) bytes() []byte {
+	return w.buf.Bytes()
+}
+
+func pointWKB(order byte, x, y float64) []byte {
+	return newWKB(order, 1).floats(x, y).bytes()
+}
+
+func lineWKB(order byte) []byte {
+	return newWKB(order, 2).uint32(2).floats(1, 2, 3, 4).bytes()
+}
+
+func polygonWKB(order byte) []byte {
+	return newWKB(order, 3).uint32(1).uint32(4).floats(0, 0, 1, 0, 1, 1, 0, 0).bytes()
+}
+
+func toJSON(t *testing.T, v interface{}) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestParseWKT(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"point", "POINT (1 2)", `{"coordinates":[1,2],"type":"Point"}`},
+		{"point z", "POINT Z (1 2 3)", `{"coordinates":[1,2],"type":"Point"}`},
+		{"point zm", "point zm(1 2 3 4)", `{"coordinates":[1,2],"type":"Point"}`},
+		{"ewkt", "SRID=4326;POINT(1 2)", `{"coordinates":[1,2],"type":"Point"}`},
+		{"linestring", "LINESTRING (1 2, 3 4)", `{"coordinates":[[1,2],[3,4]],"type":"LineString"}`},
+		{"polygon", "POLYGON ((0 0, 1 0, 1 1, 0 0))", `{"coordinates":[[[0,0],[1,0],[1,1],[0,0]]],"type":"Polygon"}`},
+		{"multipoint", "MULTIPOINT (1 2, 3 4)", `{"coordinates":[[1,2],[3,4]],"type":"MultiPoint"}`},
+		{"multipoint wrapped", "MULTIPOINT ((1 2), (3 4))", `{"coordinates":[[1,2],[3,4]],"type":"MultiPoint"}`},
+		{"multilinestring", "MULTILINESTRING ((1 2, 3 4), (5 6, 7 8))", `{"coordinates":[[[1,2],[3,4]],[[5,6],[7,8]]],"type":"MultiLineString"}`},
+		{"multipolygon", "MULTIPOLYGON (((0 0, 1 0, 1 1, 0 0)))", `{"coordinates":[[[[0,0],[1,0],[1,1],[0,0]]]],"type":"MultiPolygon"}`},
+		{"geometrycollection", "GEOMETRYCOLLECTION (POINT (1 2), LINESTRING (1 2, 3 4))", `{"geometries":[{"coordinates":[1,2],"type":"Point"},{"coordinates":[[1,2],[3,4]],"type":"LineString"}],"type":"GeometryCollection"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseWKT(tt.input)
+			if err != nil {
+				t.Fatalf("parseWKT(%q) error: %v", tt.input, err)
+			}
+			if s := toJSON(t, got); s != tt.want {
+				t.Errorf("parseWKT(%q) = %s, want %s", tt.input, s, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseWKTInvalid(t *testing.T) {
+	inputs := []string{
+		"",
+		"CIRCLE (1 2)",
+		"POINT EMPTY",
+		"POINT (1)",
+		"POINT (1 2",
+		"POINT (1 2) extra",
+		"LINESTRING (1 2, )",
+		"POLYGON (0 0, 1 1)",
+		"GEOMETRYCOLLECTION (POINT (1 2)",
+	}
+	for _, input := range inputs {
+		if got, err := parseWKT(input); err == nil {
+			t.Errorf("parseWKT(%q) = %v, want error", input, got)
+		}
+	}
+}
+
+func TestParseWKBGeometry(t *testing.T) {
+	multiPoint := newWKB(1, 4).uint32(2).raw(pointWKB(1, 1, 2)).raw(pointWKB(0, 3, 4)).bytes()
+	multiLine := newWKB(1, 5).uint32(1).raw(lineWKB(1)).bytes()
+	multiPolygon := newWKB(0, 6).uint32(1).raw(polygonWKB(0)).bytes()
+	collection := newWKB(1, 7).uint32(2).raw(pointWKB(1, 1, 2)).raw(lineWKB(0)).bytes()
+	mysql := append([]byte{0xe6, 0x10, 0, 0}, pointWKB(1, 1, 2)...)
+
+	tests := []struct {
+		name  string
+		input []byte
+		want  string
+	}{
+		{"point little endian", pointWKB(1, 1, 2), `{"coordinates":[1,2],"type":"Point"}`},
+		{"point big endian", pointWKB(0, 1, 2), `{"coordinates":[1,2],"type":"Point"}`},
+		{"linestring", lineWKB(1), `{"coordinates":[[1,2],[3,4]],"type":"LineString"}`},
+		{"polygon", polygonWKB(0), `{"coordinates":[[[0,0],[1,0],[1,1],[0,0]]],"type":"Polygon"}`},
+		{"multipoint", multiPoint, `{"coordinates":[[1,2],[3,4]],"type":"MultiPoint"}`},
+		{"multilinestring", multiLine, `{"coordinates":[[[1,2],[3,4]]],"type":"MultiLineString"}`},
+		{"multipolygon", multiPolygon, `{"coordinates":[[[[0,0],[1,0],[1,1],[0,0]]]],"type":"MultiPolygon"}`},
+		{"geometrycollection", collection, `{"geometries":[{"coordinates":[1,2],"type":"Point"},{"coordinates":[[1,2],[3,4]],"type":"LineString"}],"type":"GeometryCollection"}`},
+		{"mysql srid prefix", mysql, `{"coordinates":[1,2],"type":"Point"}`},
+		{"ewkb z", newWKB(1, 0x80000001).floats(1, 2, 3).bytes(), `{"coordinates":[1,2],"type":"Point"}`},
+		{"ewkb m", newWKB(1, 0x40000001).floats(1, 2, 3).bytes(), `{"coordinates":[1,2],"type":"Point"}`},
+		{"ewkb zm", newWKB(0, 0xc0000002).uint32(1).floats(1, 2, 3, 4).bytes(), `{"coordinates":[[1,2]],"type":"LineString"}`},
+		{"ewkb srid", newWKB(1, 0x20000001).uint32(4326).floats(1, 2).bytes(), `{"coordinates":[1,2],"type":"Point"}`},
+		{"iso z", newWKB(1, 1001).floats(1, 2, 3).bytes(), `{"coordinates":[1,2],"type":"Point"}`},
+		{"iso zm", newWKB(1, 3001).floats(1, 2, 3, 4).bytes(), `{"coordinates":[1,2],"type":"Point"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseWKBGeometry(tt.input)
+			if err != nil {
+				t.Fatalf("parseWKBGeometry(%x) error: %v", tt.input, err)
+			}
+			if s := toJSON(t, got); s != tt.want {
+				t.Errorf("parseWKBGeometry(%x) = %s, want %s", tt.input, s, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseWKBGeometryInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{"bad byte order", []byte{2, 1, 0, 0, 0}},
+		{"truncated type", []byte{1, 1, 0}},
+		{"truncated point", pointWKB(1, 1, 2)[:12]},
+		{"unsupported type", newWKB(1, 8).floats(1, 2).bytes()},
+		{"empty point", pointWKB(1, math.NaN(), math.NaN())},
+		{"trailing bytes", append(pointWKB(1, 1, 2), 0)},
+		{"too many points", newWKB(1, 2).uint32(1000).floats(1, 2).bytes()},
+		{"truncated member", newWKB(1, 4).uint32(2).raw(pointWKB(1, 1, 2)).bytes()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := parseWKBGeometry(tt.input); err == nil {
+				t.Errorf("parseWKBGeometry(%x) = %v, want error", tt.input, got)
+			}
+		})
+	}
+}
+
+func TestConvertGeoShape(t *testing.T) {
+	esColumn := EsColumn{Name: "shape"}
+	tests := []struct {
+		name   string
+		column element.Column
+		want   string
+	}{
+		{"wkt", newStringColumn("shape", "POINT (1 2)"), `{"coordinates":[1,2],"type":"Point"}`},
+		{"hex wkb", newStringColumn("shape", hex.EncodeToString(pointWKB(1, 1, 2))), `{"coordinates":[1,2],"type":"Point"}`},
+		{"hex wkb with prefix", newStringColumn("shape", "0x"+hex.EncodeToString(pointWKB(0, 1, 2))), `{"coordinates":[1,2],"type":"Point"}`},
+		{"geojson", newStringColumn("shape", `{"type":"Point","coordinates":[1,2]}`), `{"coordinates":[1,2],"type":"Point"}`},
+		{"bytes", element.NewDefaultColumn(element.NewBytesColumnValue(pointWKB(1, 1, 2)), "shape", 0), `{"coordinates":[1,2],"type":"Point"}`},
+		{"empty string", newStringColumn("shape", " "), `null`},
+		{"empty bytes", element.NewDefaultColumn(element.NewBytesColumnValue([]byte{}), "shape", 0), `null`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := convertGeoShape(esColumn, tt.column)
+			if err != nil {
+				t.Fatalf("convertGeoShape error: %v", err)
+			}
+			if s := toJSON(t, got); s != tt.want {
+				t.Errorf("convertGeoShape = %s, want %s", s, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvertGeoPoint(t *testing.T) {
+	tests := []struct {
+		format  string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{GEO_FORMAT_LAT_LON, "41.12,-71.34", `{"lat":41.12,"lon":-71.34}`, false},
+		{GEO_FORMAT_LON_LAT, "-71.34 41.12", `{"lat":41.12,"lon":-71.34}`, false},
+		{GEO_FORMAT_WKT, "POINT (-71.34 41.12)", `{"lat":41.12,"lon":-71.34}`, false},
+		{GEO_FORMAT_GEOHASH, "s", `{"lat":22.5,"lon":22.5}`, false},
+		{"", "drm3btev3e86", `"drm3btev3e86"`, false},
+		{GEO_FORMAT_LAT_LON, "91,0", "", true},
+		{GEO_FORMAT_LAT_LON, "1", "", true},
+		{GEO_FORMAT_WKT, "LINESTRING (1 2, 3 4)", "", true},
+		{GEO_FORMAT_GEOHASH, "a", "", true},
+		{GEO_FORMAT_LAT, "-90", "", false},
+		{GEO_FORMAT_LAT, "90.5", "", true},
+		{GEO_FORMAT_LON, "180", "", false},
+		{GEO_FORMAT_LON, "-180.5", "", true},
+	}
+	for _, tt := range tests {
+		esColumn := EsColumn{Name: "location", GeoFormat: tt.format}
+		got, err := convertGeoPoint(esColumn, newStringColumn("location", tt.input))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("convertGeoPoint(%s, %q) = %v, want error", tt.format, tt.input, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("convertGeoPoint(%s, %q) error: %v", tt.format, tt.input, err)
+			continue
+		}
+		if _, ok := got.(geoPointPart); ok {
+			continue
+		}
+		if s := toJSON(t, got); s != tt.want {
+			t.Errorf("convertGeoPoint(%s, %q) = %s, want %s", tt.format, tt.input, s, tt.want)
+		}
+	}
+}
+
+func TestCheckGeoPointParts(t *testing.T) {
+	tests := []struct {
+		name    string
+		columns []EsColumn
+		wantErr bool
+	}{
+		{"pair", []EsColumn{{Name: "loc", GeoFormat: GEO_FORMAT_LAT}, {Name: "loc", GeoFormat: GEO_FORMAT_LON}}, false},
+		{"no parts", []EsColumn{{Name: "loc", GeoFormat: GEO_FORMAT_LAT_LON}}, false},
+		{"lone lat", []EsColumn{{Name: "loc", GeoFormat: GEO_FORMAT_LAT}}, true},
+		{"different names", []EsColumn{{Name: "a", GeoFormat: GEO_FORMAT_LAT}, {Name: "b", GeoFormat: GEO_FORMAT_LON}}, true},
+		{"two lat", []EsColumn{{Name: "loc", GeoFormat: GEO_FORMAT_LAT}, {Name: "loc", GeoFormat: GEO_FORMAT_LAT}}, true},
+		{"three parts", []EsColumn{{Name: "loc", GeoFormat: GEO_FORMAT_LAT}, {Name: "loc", GeoFormat: GEO_FORMAT_LON}, {Name: "loc", GeoFormat: GEO_FORMAT_LON}}, true},
+		{"mixed with full point", []EsColumn{{Name: "loc", GeoFormat: GEO_FORMAT_LAT}, {Name: "loc", GeoFormat: GEO_FORMAT_LON}, {Name: "loc", GeoFormat: GEO_FORMAT_WKT}}, true},
+	}
+	for _, tt := range tests {
+		if err := checkGeoPointParts(tt.columns); (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkGeoPointParts error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCheckMergedGeoPoints(t *testing.T) {
+	columns := []EsColumn{{Name: "loc", GeoFormat: GEO_FORMAT_LAT}, {Name: "loc", GeoFormat: GEO_FORMAT_LON}}
+	tests := []struct {
+		name      string
+		data      map[string]interface{}
+		writeNull bool
+		want      string
+		wantErr   bool
+	}{
+		{"both", map[string]interface{}{"loc": map[string]interface{}{"lat": 1.5, "lon": 2.5}}, false, `{"loc":{"lat":1.5,"lon":2.5}}`, false},
+		{"lat only", map[string]interface{}{"loc": map[string]interface{}{"lat": 1.5}}, false, "", true},
+		{"lon only", map[string]interface{}{"loc": map[string]interface{}{"lon": 2.5}}, true, "", true},
+		{"both null", map[string]interface{}{}, false, `{}`, false},
+		{"both null write null", map[string]interface{}{}, true, `{"loc":null}`, false},
+	}
+	for _, tt := range tests {
+		err := checkMergedGeoPoints(columns, tt.data, tt.writeNull)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: checkMergedGeoPoints = %v, want error", tt.name, tt.data)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: checkMergedGeoPoints error: %v", tt.name, err)
+			continue
+		}
+		if s := toJSON(t, tt.data); s != tt.want {
+			t.Errorf("%s: data = %s, want %s", tt.name, s, tt.want)
+		}
+	}
+}
@@ -3,11 +3,11 @@ package elasticsearch
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"log"
 	"log/slog"
-	"os"
+	"net/http"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
@@ -22,6 +22,10 @@ type Job struct {
 	RetryTimes             int64
 	SleepTimeInMilliSecond int64
 	settingsCache          *string
+	// 重建索引时备份的老索引别名和mappings，和settingsCache一样在重试之间保留
+	indexCache *indexCache
+	// highspeed模式下被修改前的索引settings，恢复后置空
+	originalSettings map[string]interface{}
 }
 
 func (j *Job) Init(ctx context.Context) (err error) {
@@ -29,6 +33,7 @@ func (j *Job) Init(ctx context.Context) (err error) {
 	j.SleepTimeInMilliSecond = GetSleepTimeInMilliSecond(conf)
 	j.RetryTimes = GetRetryTimes(conf)
 	j.settingsCache = new(string)
+	j.indexCache = &indexCache{}
 	return
 }
 
@@ -36,34 +41,158 @@ var mutex = &sync.Mutex{}
 
 func (j *Job) Prepare(ctx context.Context) (err error) {
 	conf := j.PluginJobConf()
-	client := ES_init(conf)
 
 	actionType := GetActionType(conf)
+	if actionType == UNKNOW {
+		return NewWriterError(BAD_CONFIG_VALUE, "unsupported actionType", nil)
+	}
 
 	hasId := HasID(conf)
 	conf.Set("hasId", hasId)
-	if UPDATE == (actionType) && !hasId && !HasPrimaryKeyInfo(conf) {
-		message := "update mode must specify column type with id or primaryKeyInfo config"
-		return errors.New(message)
+	if (UPDATE == actionType || DELETE == actionType) && !hasId && !HasPrimaryKeyInfo(conf) {
+		message := fmt.Sprintf("%s mode must specify column type with id or primaryKeyInfo config", strings.ToLower(actionType.String()))
+		return NewWriterError(BAD_CONFIG_VALUE, message, nil)
+	}
+	if HasOpColumn(conf) {
+		for code, action := range GetActionMapping(conf) {
+			if action == UNKNOW {
+				message := fmt.Sprintf("actionMapping %s has unsupported action type", code)
+				return NewWriterError(BAD_CONFIG_VALUE, message, nil)
+			}
+		}
+		if !hasId && !HasPrimaryKeyInfo(conf) {
+			return NewWriterError(BAD_CONFIG_VALUE, "op column must specify column type with id or primaryKeyInfo config", nil)
+		}
+	}
+	if GetMappingPolicy(conf) == "" {
+		return NewWriterError(BAD_CONFIG_VALUE, "mappingPolicy must be strict, extend or ignore", nil)
+	}
+	if IsTruncate(conf) && GetTruncateMode(conf) == "" {
+		return NewWriterError(BAD_CONFIG_VALUE, "truncateMode must be recreate or deleteByQuery", nil)
+	}
+	if GetVersioning(conf) && (actionType == UPDATE || actionType == CREATE) {
+		message := fmt.Sprintf("versioning is not supported by %s mode", strings.ToLower(actionType.String()))
+		return NewWriterError(BAD_CONFIG_VALUE, message, nil)
+	}
+	if IsMirror(conf) {
+		if err = checkMirror(conf); err != nil {
+			return err
+		}
+	}
+	client, err := ES_init(conf)
+	if err != nil {
+		return err
 	}
 	setCache := j.settingsCache
+	indexCache := j.indexCache
 	mutex.Lock()
 	defer mutex.Unlock()
-	jobExecuteWithRetry(doJobPrepare, client, ctx, conf, setCache, int(j.RetryTimes), time.Duration(j.SleepTimeInMilliSecond))
+	_, err = jobExecuteWithRetry(doJobPrepare, client, ctx, conf, setCache, indexCache, int(j.RetryTimes), time.Duration(j.SleepTimeInMilliSecond)*time.Millisecond)
+	if err != nil {
+		return
+	}
+	if IsHighSpeedMode(conf) {
+		j.originalSettings, err = enterHighSpeedMode(client, ctx, conf)
+	}
 	return
 }
 
-func jobExecuteWithRetry(operation func(*elastic.Client, context.Context, *config.JSON, *string) (bool, error),
-	client *elastic.Client, ctx context.Context, conf *config.JSON, settingsCache *string, maxRetries int, retryInterval time.Duration) (bool, error) {
+// highSpeedSettings highspeed模式下写入期间使用的settings
+var highSpeedSettings = map[string]interface{}{
+	"index.refresh_interval":   "-1",
+	"index.number_of_replicas": 0,
+}
+
+// enterHighSpeedMode 关闭refresh和副本加快写入，返回原来的settings用于恢复
+func enterHighSpeedMode(client *elastic.Client, ctx context.Context, conf *config.JSON) (map[string]interface{}, error) {
+	indexName := GetIndexName(conf)
+	result, err := client.IndexGetSettings(indexName).FlatSettings(true).Do(ctx)
+	if err != nil {
+		message := fmt.Sprintf("get settings of index %s failed", indexName)
+		return nil, NewWriterError(CLUSTER_UNREACHABLE, message, err)
+	}
+	original := make(map[string]interface{}, len(highSpeedSettings))
+	for key := range highSpeedSettings {
+		// 没有显式设置的值恢复时用null重置为默认值
+		original[key] = nil
+		if settings := result[indexName]; settings != nil {
+			if v, ok := settings.Settings[key]; ok {
+				original[key] = v
+			}
+		}
+	}
+	if err = putIndexSettings(client, ctx, indexName, highSpeedSettings); err != nil {
+		return nil, err
+	}
+	slog.Info(fmt.Sprintf("index [%s] enter highspeed mode with settings %v, original settings %v", indexName, highSpeedSettings, original))
+	return original, nil
+}
+
+// exitHighSpeedMode 恢复highspeed模式修改前的settings并refresh
+func (j *Job) exitHighSpeedMode(client *elastic.Client, ctx context.Context, conf *config.JSON) error {
+	if j.originalSettings == nil {
+		return nil
+	}
+	indexName := GetIndexName(conf)
+	if err := putIndexSettings(client, ctx, indexName, j.originalSettings); err != nil {
+		return err
+	}
+	j.originalSettings = nil
+	slog.Info(fmt.Sprintf("index [%s] settings restored from highspeed mode", indexName))
+	if _, err := client.Refresh(indexName).Do(ctx); err != nil {
+		message := fmt.Sprintf("refresh index %s failed", indexName)
+		return NewWriterError(CLUSTER_UNREACHABLE, message, err)
+	}
+	return nil
+}
+
+func putIndexSettings(client *elastic.Client, ctx context.Context, indexName string, settings map[string]interface{}) error {
+	result, err := client.IndexPutSettings(indexName).BodyJson(settings).Do(ctx)
+	if err != nil {
+		message := fmt.Sprintf("update settings of index %s failed", indexName)
+		return NewWriterError(ES_SETTINGS_UPDATE, message, err)
+	}
+	if !result.Acknowledged {
+		message := fmt.Sprintf("update settings of index %s not acknowledged", indexName)
+		return NewWriterError(ES_SETTINGS_UPDATE, message, nil)
+	}
+	return nil
+}
+
+// forceMerge 合并segment，减少写入完成后的segment数量
+func forceMerge(client *elastic.Client, ctx context.Context, conf *config.JSON, segments int) error {
+	indexName := GetIndexName(conf)
+	start := time.Now()
+	if _, err := client.Forcemerge(indexName).MaxNumSegments(segments).Do(ctx); err != nil {
+		message := fmt.Sprintf("force merge index %s to %d segments failed", indexName, segments)
+		return NewWriterError(ES_FORCE_MERGE, message, err)
+	}
+	slog.Info(fmt.Sprintf("index [%s] force merged to %d segments in %v", indexName, segments, time.Since(start)))
+	return nil
+}
+
+// indexCache 删除老索引前备份的别名和mappings
+type indexCache struct {
+	aliases  map[string]interface{}
+	mappings map[string]interface{}
+}
+
+func jobExecuteWithRetry(operation func(*elastic.Client, context.Context, *config.JSON, *string, *indexCache) (bool, error),
+	client *elastic.Client, ctx context.Context, conf *config.JSON, settingsCache *string, indexCache *indexCache, maxRetries int, retryInterval time.Duration) (bool, error) {
 
 	var success bool
 	var err error
 	for attempt := 0; attempt < maxRetries; attempt++ {
-		success, err = operation(client, ctx, conf, settingsCache)
+		success, err = operation(client, ctx, conf, settingsCache, indexCache)
 		if err == nil {
 			// 操作成功，跳出循环
 			break
 		}
+		if success {
+			// 操作失败，重试不了了
+			slog.Error(fmt.Sprintf("operation failed, %s", err))
+			break
+		}
 		// 操作失败，等待一段时间后重试
 		slog.Error(fmt.Sprintf("operation failed, retrying after %s (attempt %d/%d)\n", retryInterval.String(), attempt+1, maxRetries))
 		time.Sleep(retryInterval)
@@ -71,79 +200,260 @@ func jobExecuteWithRetry(operation func(*elastic.Client, context.Context, *confi
 	return success, err
 }
 
-func doJobPrepare(client *elastic.Client, ctx context.Context, conf *config.JSON, settingsCache *string) (flag bool, err error) {
+func doJobPrepare(client *elastic.Client, ctx context.Context, conf *config.JSON, settingsCache *string, indexCache *indexCache) (flag bool, err error) {
 	indexName := GetIndexName(conf)
 	typeName := GetTypeName(conf)
 	dynamic := GetDynamic(conf)
 	dstDynamic := GetDstDynamic(conf)
-	newSettings, _ := json.Marshal(GetSettings(conf))
+	var confSettings map[string]interface{}
+	rawSettings, _ := json.Marshal(GetSettings(conf))
+	json.Unmarshal(rawSettings, &confSettings)
+	newSettings, _ := json.Marshal(normalizeSettings(confSettings))
 	slog.Info(fmt.Sprintf("conf settings:%v, settingsCache:%v", newSettings, settingsCache))
 
 	isGreaterOrEqualThan7 := IsGreaterOrEqualThan7(conf, client)
 
-	mappings := GenMappings(dstDynamic, typeName, isGreaterOrEqualThan7, conf)
+	mappings, err := GenMappings(dstDynamic, typeName, isGreaterOrEqualThan7, conf)
+	if err != nil {
+		return true, err
+	}
 	slog.Info(fmt.Sprintf("index:[%s], type:[%s], mappings:[%s]", indexName, typeName, mappings))
 	// conf.set("isGreaterOrEqualThan7", isGreaterOrEqualThan7)
 	var isIndicesExists bool
-	isIndicesExists, _ = client.IndexExists(indexName).Do(ctx)
+	isIndicesExists, err = client.IndexExists(indexName).Do(ctx)
+	if err != nil {
+		return false, NewWriterError(CLUSTER_UNREACHABLE, "check index exists failed", err)
+	}
 	if isIndicesExists {
 		oldMappings, _ := client.GetMapping().Index(indexName).Do(ctx)
 		slog.Info(fmt.Sprintf("the mappings for old index is: %v", oldMappings))
 	}
-	if IsTruncate(conf) && isIndicesExists {
-		// 备份老的索引中的settings到缓存
-		oldOriginSettings, _ := client.IndexGetSettings().Index(indexName).Do(ctx)
-		if oldOriginSettings != nil {
-			setts := oldOriginSettings[indexName]
-			for _, v := range setts.Settings {
+	if IsTruncate(conf) && isIndicesExists && GetTruncateMode(conf) == TRUNCATE_DELETE_BY_QUERY {
+		// 原地清空索引，保留settings、mappings和别名
+		if err = truncateByQuery(client, ctx, conf); err != nil {
+			return false, err
+		}
+	} else if IsTruncate(conf) && isIndicesExists {
+		// 备份老的索引中的settings、别名和mappings
+		oldIndex, err := client.IndexGet(indexName).Do(ctx)
+		if err != nil {
+			message := fmt.Sprintf("get index %s failed", indexName)
+			return false, NewWriterError(CLUSTER_UNREACHABLE, message, err)
+		}
+		if old := oldIndex[indexName]; old != nil {
+			for _, v := range old.Settings {
 				vJson, _ := json.Marshal(v)
-				flagJson := convertSettings(string(vJson))
+				flagJson := convertSettings(string(vJson), GetIncludeSettings(conf))
 				slog.Info(fmt.Sprintf("merge1 settings:%v, settingsCache:%v,", flagJson, settingsCache))
 
 				setSettings(settingsCache, flagJson)
 			}
+			// 删除后创建失败重试时老索引已经不存在，需要用缓存的别名和mappings
+			indexCache.aliases = old.Aliases
+			indexCache.mappings = old.Mappings
 		}
 		_, err = client.DeleteIndex(indexName).Do(ctx)
 		if err != nil {
-			panic(err)
+			message := fmt.Sprintf("delete index %s failed", indexName)
+			return false, NewWriterError(ES_INDEX_DELETE, message, err)
 		}
 	}
 
 	// 更新缓存中的settings
 	setSettings(settingsCache, string(newSettings))
 	// 再次查询，上面有可能删除了
-	isIndicesExists, _ = client.IndexExists(indexName).Do(ctx)
+	isIndicesExists, err = client.IndexExists(indexName).Do(ctx)
+	if err != nil {
+		return false, NewWriterError(CLUSTER_UNREACHABLE, "check index exists failed", err)
+	}
 	if !isIndicesExists {
 
-		body := GenBody(*settingsCache, mappings, dynamic)
-		fmt.Println(body)
+		mappings = mergeMappings(mappings, indexCache.mappings)
+		body := GenBody(*settingsCache, mappings, dynamic, indexCache.aliases)
+		slog.Info(fmt.Sprintf("create index:[%s], body:[%s]", indexName, body))
 		createIndex, err := client.CreateIndex(indexName).BodyString(body).Do(ctx)
 
 		if err != nil {
-			panic(err)
+			message := fmt.Sprintf("create index %s failed", indexName)
+			// 400是索引配置被拒绝，重试也不会成功
+			return elastic.IsStatusCode(err, http.StatusBadRequest), NewWriterError(ES_INDEX_CREATE, message, err)
 		}
 		if !createIndex.Acknowledged {
 			// Not acknowledged ,创建失败
-			fmt.Println("Not acknowledged")
+			message := fmt.Sprintf("create index %s not acknowledged", indexName)
+			return false, NewWriterError(ES_INDEX_CREATE, message, nil)
 		}
+		return true, nil
+	}
+	// dynamic模式下创建索引时也不带mapping，字段类型由es推断，不需要检查
+	if dynamic {
+		return true, nil
 	}
-	return true, nil
+	// 索引已存在，检查配置的mapping和索引的mapping是否一致
+	return syncMappings(client, ctx, conf, mappings)
 }
 
-func convertSettings(dataStr string) string {
+// readOnlySettings 索引创建时由es生成的settings，重建索引时不能带上
+var readOnlySettings = []string{"uuid", "creation_date", "provided_name", "version.created", "version.upgraded", "resize", "routing.allocation.initial_recovery"}
+
+// convertSettings 从老索引的settings中挑出includeKeys，includeKeys为空时保留全部，只读的settings总是去掉
+func convertSettings(dataStr string, includeKeys []string) string {
 	var obj map[string]interface{}
 	// 解码JSON1到obj1
 	json.Unmarshal([]byte(dataStr), &obj)
 
-	keys := []string{"number_of_shards", "number_of_replicas"}
-	newObj := make(map[string]interface{}, 0)
-	for _, v2 := range keys {
-		newObj[v2] = obj[v2]
+	if len(includeKeys) > 0 {
+		newObj := make(map[string]interface{})
+		for _, key := range includeKeys {
+			copyPath(obj, newObj, key)
+		}
+		obj = newObj
+	}
+	for _, key := range readOnlySettings {
+		removePath(obj, key)
 	}
-	json, _ := json.Marshal(newObj)
+	json, _ := json.Marshal(obj)
 	return string(json)
 }
 
+// copyPath 把以点分隔的嵌套路径从src复制到dst，不存在的路径忽略
+func copyPath(src, dst map[string]interface{}, path string) {
+	keys := strings.Split(path, ".")
+	for i, key := range keys {
+		v, ok := src[key]
+		if !ok {
+			return
+		}
+		if i == len(keys)-1 {
+			dst[key] = v
+			return
+		}
+		child, ok := v.(map[string]interface{})
+		if !ok {
+			return
+		}
+		next, ok := dst[key].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			dst[key] = next
+		}
+		src, dst = child, next
+	}
+}
+
+// removePath 删除以点分隔的嵌套路径，删除后为空的父节点一并去掉
+func removePath(obj map[string]interface{}, path string) {
+	key, rest, nested := strings.Cut(path, ".")
+	if !nested {
+		delete(obj, key)
+		return
+	}
+	child, ok := obj[key].(map[string]interface{})
+	if !ok {
+		return
+	}
+	removePath(child, rest)
+	if len(child) == 0 {
+		delete(obj, key)
+	}
+}
+
+// mergeMappings 把老索引中有、配置中没有的字段合并到新的mappings中，配置的字段优先
+func mergeMappings(mappings string, oldMappings map[string]interface{}) string {
+	var newMappings map[string]interface{}
+	if err := json.Unmarshal([]byte(mappings), &newMappings); err != nil || len(oldMappings) == 0 {
+		return mappings
+	}
+	if _, ok := newMappings["properties"]; ok {
+		mergeTypeMappings(newMappings, oldMappings)
+	} else {
+		// 7.x之前的版本mappings外面还有一层typeName
+		for typeName, v := range newMappings {
+			newType, ok1 := v.(map[string]interface{})
+			oldType, ok2 := oldMappings[typeName].(map[string]interface{})
+			if ok1 && ok2 {
+				mergeTypeMappings(newType, oldType)
+			}
+		}
+	}
+	merged, _ := json.Marshal(newMappings)
+	return string(merged)
+}
+
+func mergeTypeMappings(newMappings, oldMappings map[string]interface{}) {
+	for k, v := range oldMappings {
+		if k != "properties" {
+			if _, ok := newMappings[k]; !ok {
+				newMappings[k] = v
+			}
+			continue
+		}
+		oldProps, ok1 := v.(map[string]interface{})
+		newProps, ok2 := newMappings[k].(map[string]interface{})
+		if !ok1 || !ok2 {
+			continue
+		}
+		for field, fieldMapping := range oldProps {
+			if _, ok := newProps[field]; !ok {
+				newProps[field] = fieldMapping
+			}
+		}
+	}
+}
+
+// truncateByQuery 用delete_by_query清空索引，配置了truncateQuery时只删除匹配的文档
+func truncateByQuery(client *elastic.Client, ctx context.Context, conf *config.JSON) error {
+	indexName := GetIndexName(conf)
+	var query elastic.Query = elastic.NewMatchAllQuery()
+	if q := GetTruncateQuery(conf); q != "" {
+		query = elastic.NewRawStringQuery(q)
+	}
+	response, err := client.DeleteByQuery(indexName).Query(query).ProceedOnVersionConflict().Refresh("true").Do(ctx)
+	if err != nil {
+		message := fmt.Sprintf("truncate index %s by query failed", indexName)
+		return NewWriterError(ES_DELETE_BY_QUERY, message, err)
+	}
+	if len(response.Failures) > 0 {
+		message := fmt.Sprintf("truncate index %s by query has %d failures", indexName, len(response.Failures))
+		return NewWriterError(ES_DELETE_BY_QUERY, message, nil)
+	}
+	slog.Info(fmt.Sprintf("truncate index [%s] by query, %d documents deleted", indexName, response.Deleted))
+	return nil
+}
+
+// normalizeSettings 去掉settings中的index前缀，并把index.analysis.analyzer.x.type这样带点的key展开成嵌套对象，
+// 这样analysis既可以按es的格式嵌套配置，也可以平铺配置，和老索引的settings合并时不会重复
+func normalizeSettings(settings map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(settings))
+	for key, v := range settings {
+		if key == "index" {
+			if m, ok := v.(map[string]interface{}); ok {
+				mergeSettings(result, normalizeSettings(m))
+				continue
+			}
+		}
+		names := strings.Split(strings.TrimPrefix(key, "index."), ".")
+		for i := len(names) - 1; i > 0; i-- {
+			v = map[string]interface{}{names[i]: v}
+		}
+		mergeSettings(result, map[string]interface{}{names[0]: v})
+	}
+	return result
+}
+
+// mergeSettings 把src逐层合并到dst，相同的key以src为准
+func mergeSettings(dst, src map[string]interface{}) {
+	for k, v := range src {
+		srcMap, ok1 := v.(map[string]interface{})
+		dstMap, ok2 := dst[k].(map[string]interface{})
+		if ok1 && ok2 {
+			mergeSettings(dstMap, srcMap)
+			continue
+		}
+		dst[k] = v
+	}
+}
+
 func setSettings(json1 *string, json2 string) {
 
 	if *json1 == "" || *json1 == "{}" {
@@ -164,10 +474,8 @@ func setSettings(json1 *string, json2 string) {
 	// 解码JSON2到obj2
 	json.Unmarshal([]byte(json2), &obj2)
 
-	// 合并两个对象,按下列keys条件合并
-	for k, v := range obj2 {
-		obj1[k] = v
-	}
+	// 合并两个对象，analysis这样的嵌套对象逐层合并
+	mergeSettings(obj1, obj2)
 
 	// 将合并后的对象编码回JSON
 	mergedJSON, _ := json.Marshal(&obj1)
@@ -176,11 +484,133 @@ func setSettings(json1 *string, json2 string) {
 }
 
 func (j *Job) Post(ctx context.Context) (err error) {
+	conf := j.PluginJobConf()
+	alias := GetAlias(conf)
+	mirror := IsMirror(conf)
+	highSpeed := j.originalSettings != nil
+	if alias == "" && !mirror && !highSpeed {
+		return
+	}
+	client, err := ES_init(conf)
+	if err != nil {
+		return err
+	}
+	if err = j.exitHighSpeedMode(client, ctx, conf); err != nil {
+		return err
+	}
+	if mirror {
+		if err = purgeStaleDocuments(client, ctx, conf); err != nil {
+			return err
+		}
+	}
+	if segments := GetForceMergeSegments(conf); highSpeed && segments > 0 {
+		if err = forceMerge(client, ctx, conf, segments); err != nil {
+			return err
+		}
+	}
+	if alias != "" {
+		return switchAlias(client, ctx, conf, alias)
+	}
 	return
 }
 
+// checkMirror 镜像模式下所有源端文档都必须被写入并打上同步版本，否则Post会把它们当成过期文档删除，
+// 因此不能和版本冲突时跳过文档的外部版本、以及把失败文档当脏数据忽略的配置一起使用
+func checkMirror(conf *config.JSON) error {
+	if GetVersioning(conf) {
+		return NewWriterError(BAD_CONFIG_VALUE, "mirror can not be used with versioning", nil)
+	}
+	for _, col := range GetColumnList(conf) {
+		if GetESFieldType(col.Type) == VERSION {
+			message := fmt.Sprintf("mirror can not be used with version column %s", col.Name)
+			return NewWriterError(BAD_CONFIG_VALUE, message, nil)
+		}
+	}
+	if IsIgnoreParseError(conf) || IsIgnoreWriteError(conf) {
+		return NewWriterError(BAD_CONFIG_VALUE, "mirror can not be used with ignoreParseError or ignoreWriteError", nil)
+	}
+	return nil
+}
+
+// purgeStaleDocuments 镜像模式下删除不是本次同步写入的文档，也就是源端已经删除的数据
+func purgeStaleDocuments(client *elastic.Client, ctx context.Context, conf *config.JSON) error {
+	indexName := GetIndexName(conf)
+	field := GetMirrorField(conf)
+	version := GetUnifiedVersion(conf)
+	// 先refresh，保证本次写入的文档都能被查询到
+	if _, err := client.Refresh(indexName).Do(ctx); err != nil {
+		message := fmt.Sprintf("refresh index %s failed", indexName)
+		return NewWriterError(CLUSTER_UNREACHABLE, message, err)
+	}
+	query := elastic.NewBoolQuery().MustNot(elastic.NewTermQuery(field, version))
+	response, err := client.DeleteByQuery(indexName).Query(query).ProceedOnVersionConflict().Refresh("true").Do(ctx)
+	if err != nil {
+		message := fmt.Sprintf("delete stale documents from index %s failed", indexName)
+		return NewWriterError(ES_DELETE_BY_QUERY, message, err)
+	}
+	if len(response.Failures) > 0 {
+		message := fmt.Sprintf("delete stale documents from index %s has %d failures", indexName, len(response.Failures))
+		return NewWriterError(ES_DELETE_BY_QUERY, message, nil)
+	}
+	slog.Info(fmt.Sprintf("mirror mode purged %d stale documents from index [%s] not stamped with %s=%d", response.Deleted, indexName, field, version))
+	return nil
+}
+
+// switchAlias 一次_aliases请求把别名指向本次写入的索引，
+// exclusive模式下同时把别名从其他索引上移除，可选删除这些旧索引
+func switchAlias(client *elastic.Client, ctx context.Context, conf *config.JSON, alias string) error {
+	indexName := GetIndexName(conf)
+	aliasService := client.Alias().Add(indexName, alias)
+
+	var oldIndices []string
+	if IsNeedCleanAlias(conf) {
+		aliasesResult, err := client.Aliases().Alias(alias).Do(ctx)
+		if err != nil && !elastic.IsNotFound(err) {
+			message := fmt.Sprintf("get indices of alias %s failed", alias)
+			return NewWriterError(ES_ALIAS_MODIFY, message, err)
+		}
+		if aliasesResult != nil {
+			for _, index := range aliasesResult.IndicesByAlias(alias) {
+				if index == indexName {
+					continue
+				}
+				aliasService.Remove(index, alias)
+				oldIndices = append(oldIndices, index)
+			}
+		}
+	}
+	result, err := aliasService.Do(ctx)
+	if err != nil {
+		message := fmt.Sprintf("update alias %s to index %s failed", alias, indexName)
+		return NewWriterError(ES_ALIAS_MODIFY, message, err)
+	}
+	if !result.Acknowledged {
+		message := fmt.Sprintf("update alias %s to index %s not acknowledged", alias, indexName)
+		return NewWriterError(ES_ALIAS_MODIFY, message, nil)
+	}
+	slog.Info(fmt.Sprintf("alias [%s] now points to index [%s], removed from %v", alias, indexName, oldIndices))
+
+	if IsDeleteOldIndex(conf) && len(oldIndices) > 0 {
+		if _, err = client.DeleteIndex(oldIndices...).Do(ctx); err != nil {
+			message := fmt.Sprintf("delete old indices %v failed", oldIndices)
+			return NewWriterError(ES_INDEX_DELETE, message, err)
+		}
+		slog.Info(fmt.Sprintf("old indices %v deleted", oldIndices))
+	}
+	return nil
+}
+
 func (j *Job) Destroy(ctx context.Context) (err error) {
-	return
+	// 任务失败时不会调用Post，这里保证highspeed模式修改的settings被恢复
+	if j.originalSettings == nil {
+		return
+	}
+	conf := j.PluginJobConf()
+	client, err := ES_init(conf)
+	if err != nil {
+		return err
+	}
+	return j.exitHighSpeedMode(client, ctx, conf)
 }
 
 func (j *Job) Split(ctx context.Context, number int) (confs []*config.JSON, err error) {
@@ -193,9 +623,10 @@ func (j *Job) Split(ctx context.Context, number int) (confs []*config.JSON, err
 type Body struct {
 	Settings interface{} `json:"settings"`
 	Mappings interface{} `json:"mappings"`
+	Aliases  interface{} `json:"aliases,omitempty"`
 }
 
-func GenBody(settings, mappings string, dynamic bool) string {
+func GenBody(settings, mappings string, dynamic bool, aliases map[string]interface{}) string {
 	if settings == "" || settings == "{}" {
 		settings = `{
 			"number_of_shards": 1,
@@ -208,6 +639,9 @@ func GenBody(settings, mappings string, dynamic bool) string {
 	body := &Body{
 		Settings: settingsMap,
 	}
+	if len(aliases) > 0 {
+		body.Aliases = aliases
+	}
 	if !dynamic {
 		var mappingsMap map[string]interface{}
 		// 解析JSON字符串到map中
@@ -220,7 +654,30 @@ func GenBody(settings, mappings string, dynamic bool) string {
 	return string(jsonData)
 }
 
-func GenMappings(dstDynamic, typeName string, isGreaterOrEqualThan7 bool, conf *config.JSON) string {
+// mappingParams 各类型字段通用的mapping参数
+var mappingParams = []string{"ignore_above", "normalizer", "search_analyzer", "index_options", "copy_to", "null_value", "similarity"}
+
+// parseMultiFields 解析fields配置，兼容之前版本把json写成字符串的配置
+func parseMultiFields(v interface{}) (map[string]interface{}, error) {
+	if str, ok := v.(string); ok {
+		if err := json.Unmarshal([]byte(str), &v); err != nil {
+			return nil, err
+		}
+	}
+	fields, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("fields must be a json object")
+	}
+	for name, sub := range fields {
+		subField, ok := sub.(map[string]interface{})
+		if !ok || subField["type"] == nil {
+			return nil, fmt.Errorf("sub field %s must be a json object with type", name)
+		}
+	}
+	return fields, nil
+}
+
+func GenMappings(dstDynamic, typeName string, isGreaterOrEqualThan7 bool, conf *config.JSON) (string, error) {
 	var mappings string
 	propMap := make(map[string]interface{})
 
@@ -229,7 +686,7 @@ func GenMappings(dstDynamic, typeName string, isGreaterOrEqualThan7 bool, conf *
 
 	arr, err := conf.GetArray("column")
 	if err != nil {
-		return ""
+		return "", NewWriterError(BAD_CONFIG_VALUE, "column must be configured", err)
 	}
 
 	if len(arr) > 0 {
@@ -238,15 +695,12 @@ func GenMappings(dstDynamic, typeName string, isGreaterOrEqualThan7 bool, conf *
 			colTypeStr, _ := col.GetString("type")
 			if colTypeStr == "" {
 				message := fmt.Sprintf("%v column must have type", col)
-				log.Fatal(message)
-				return ""
+				return "", NewWriterError(BAD_CONFIG_VALUE, message, nil)
 			}
 			colType := GetESFieldType(colTypeStr)
 			if colType == -1 {
-				// throw DataXException.asDataXException(ElasticSearchWriterErrorCode.BAD_CONFIG_VALUE, col.toString() + " unsupported type");
 				message := fmt.Sprintf("%v unsupported type", col)
-				log.Fatal(message)
-				return ""
+				return "", NewWriterError(UNSUPPORTED_TYPE, message, nil)
 			}
 
 			var columnItem = &EsColumn{}
@@ -276,8 +730,8 @@ func GenMappings(dstDynamic, typeName string, isGreaterOrEqualThan7 bool, conf *
 				columnItem.CombineFieldsValueSeparator = combineFieldsValueSeparator
 			}
 
-			// 如果是id，version，routing，不需要创建mapping
-			if colType == ID || colType == VERSION || colType == ROUTING {
+			// 如果是id，version，routing，op，不需要创建mapping
+			if colType == ID || colType == VERSION || colType == ROUTING || colType == OP {
 				columnList = append(columnList, *columnItem)
 				continue
 			}
@@ -291,6 +745,7 @@ func GenMappings(dstDynamic, typeName string, isGreaterOrEqualThan7 bool, conf *
 			columnItem.DstArray = false
 			array, _ := col.GetBool("array")
 			columnItem.Array = array
+			columnItem.ArrayFormat = GetArrayFormat(col)
 			dstArray, _ := col.GetBool("dstArray")
 			columnItem.DstArray = dstArray
 
@@ -301,8 +756,6 @@ func GenMappings(dstDynamic, typeName string, isGreaterOrEqualThan7 bool, conf *
 			field["type"] = colTypeStr
 			doc_values, _ := col.GetBool("doc_values")
 			field["doc_values"] = doc_values
-			// TODO ignore_above, _ := col.GetInt64("ignore_above")
-			// field["ignore_above"] = ignore_above
 			inx, _ := col.GetBool("index")
 			field["index"] = inx
 			switch colType {
@@ -319,12 +772,6 @@ func GenMappings(dstDynamic, typeName string, isGreaterOrEqualThan7 bool, conf *
 				// 优化disk使用,也同步会提高index性能
 				norms, _ := col.GetBool("norms")
 				field["norms"] = norms
-				// TODO index_options, _ := col.GetBool("index_options")
-				// field["index_options"] = index_options
-				fds, err := col.GetString("fields")
-				if err == nil && fds != "" {
-					field["fields"] = fds
-				}
 			case DATE:
 				origin, _ := col.GetBool("origin")
 				if origin {
@@ -342,8 +789,98 @@ func GenMappings(dstDynamic, typeName string, isGreaterOrEqualThan7 bool, conf *
 					timezone, _ := col.GetString("timezone")
 					columnItem.Timezone = timezone
 					formart, _ := col.GetString("format")
-					columnItem.Format = formart
+					columnItem.Format = toGoLayout(formart)
+					// 输入的日期格式，可以配置多个，依次尝试
+					if srcFormat, err := col.GetString("srcFormat"); err == nil && srcFormat != "" {
+						columnItem.SrcFormat = []string{toGoLayout(srcFormat)}
+					} else if srcFormats, err := col.GetArray("srcFormat"); err == nil {
+						for _, f := range srcFormats {
+							var format string
+							json.Unmarshal([]byte(f.String()), &format)
+							columnItem.SrcFormat = append(columnItem.SrcFormat, toGoLayout(format))
+						}
+					}
+				}
+			case DENSE_VECTOR:
+				// dense_vector不支持doc_values，index和similarity只在配置时设置，兼容7.x
+				delete(field, "doc_values")
+				if _, err := col.GetBool("index"); err != nil {
+					delete(field, "index")
+				}
+				dims, err := col.GetInt64("dims")
+				if err == nil {
+					if dims <= 0 {
+						message := fmt.Sprintf("column %s dims must be positive", colName)
+						return "", NewWriterError(BAD_CONFIG_VALUE, message, nil)
+					}
+					field["dims"] = dims
+					columnItem.Dims = int(dims)
+				}
+				similarity, err := col.GetString("similarity")
+				if err == nil && similarity != "" {
+					field["similarity"] = similarity
+				}
+			case TOKEN_COUNT:
+				// token_count必须指定analyzer
+				analyzer, _ := col.GetString("analyzer")
+				if analyzer == "" {
+					analyzer = "standard"
+				}
+				field["analyzer"] = analyzer
+			case SCALED_FLOAT:
+				scalingFactor, err := col.GetFloat64("scaling_factor")
+				if err != nil || scalingFactor <= 0 {
+					message := fmt.Sprintf("column %s of type scaled_float must have positive scaling_factor", colName)
+					return "", NewWriterError(BAD_CONFIG_VALUE, message, nil)
+				}
+				field["scaling_factor"] = scalingFactor
+			case SEARCH_AS_YOU_TYPE:
+				delete(field, "doc_values")
+				analyzer, _ := col.GetString("analyzer")
+				if analyzer != "" {
+					field["analyzer"] = analyzer
+				}
+				maxShingleSize, err := col.GetInt64("max_shingle_size")
+				if err == nil {
+					field["max_shingle_size"] = maxShingleSize
+				}
+			case CONSTANT_KEYWORD:
+				delete(field, "doc_values")
+				delete(field, "index")
+				value, err := col.GetString("value")
+				if err == nil {
+					field["value"] = value
+				}
+			case ALIAS:
+				// alias字段只能指向其他字段，不能写入
+				path, _ := col.GetString("path")
+				if path == "" {
+					message := fmt.Sprintf("column %s of type alias must have path", colName)
+					return "", NewWriterError(BAD_CONFIG_VALUE, message, nil)
+				}
+				field = map[string]interface{}{"type": "alias", "path": path}
+			case JOIN:
+				relations, err := col.GetJSON("relations")
+				if err != nil {
+					message := fmt.Sprintf("column %s of type join must have relations", colName)
+					return "", NewWriterError(BAD_CONFIG_VALUE, message, err)
 				}
+				var relationsMap map[string]interface{}
+				json.Unmarshal([]byte(relations.String()), &relationsMap)
+				field = map[string]interface{}{"type": "join", "relations": relationsMap}
+			case VERSION_FIELD:
+				field = map[string]interface{}{"type": "version"}
+			case WILDCARD, MATCH_ONLY_TEXT, HISTOGRAM, COMPLETION, SPARSE_VECTOR, RANK_FEATURES:
+				// 这些类型不支持doc_values和index参数
+				delete(field, "doc_values")
+				delete(field, "index")
+			case GEO_POINT:
+				geoFormat, _ := col.GetString("geoFormat")
+				if geoFormat != "" && !slices.Contains(geoFormats, geoFormat) {
+					message := fmt.Sprintf("column %s has unsupported geoFormat %s", colName, geoFormat)
+					return "", NewWriterError(BAD_CONFIG_VALUE, message, nil)
+				}
+				columnItem.GeoFormat = geoFormat
 			case GEO_SHAPE:
 				tree, _ := col.GetString("tree")
 				field["tree"] = tree
@@ -357,6 +894,26 @@ func GenMappings(dstDynamic, typeName string, isGreaterOrEqualThan7 bool, conf *
 				}
 			default:
 			}
+			// 通用的mapping参数，配置了才设置
+			var colMap map[string]interface{}
+			json.Unmarshal([]byte(col.String()), &colMap)
+			for _, key := range mappingParams {
+				if _, ok := field[key]; ok {
+					continue
+				}
+				if value, ok := colMap[key]; ok {
+					field[key] = value
+				}
+			}
+			// 多字段，比如text字段带一个keyword子字段，可以是json对象或者json字符串
+			if fds, ok := colMap["fields"]; ok {
+				fields, err := parseMultiFields(fds)
+				if err != nil {
+					message := fmt.Sprintf("column %s has invalid fields", colName)
+					return "", NewWriterError(BAD_CONFIG_VALUE, message, err)
+				}
+				field["fields"] = fields
+			}
 			other_params, err := col.GetString("other_params")
 			if err == nil && other_params != "" {
 				var obj2 map[string]interface{}
@@ -371,13 +928,30 @@ func GenMappings(dstDynamic, typeName string, isGreaterOrEqualThan7 bool, conf *
 			columnList = append(columnList, *columnItem)
 		}
 	}
+	if err := checkGeoPointParts(columnList); err != nil {
+		return "", NewWriterError(BAD_CONFIG_VALUE, err.Error(), nil)
+	}
 
-	version := time.Now().Unix()
+	// 配置了version时使用配置的版本，重跑旧快照时不会覆盖新数据
+	version, _ := conf.GetInt64("version")
+	if version <= 0 {
+		version = time.Now().Unix()
+	}
 	slog.Info(fmt.Sprintf("unified version: %v", version))
 	conf.Set("version", version)
 	colJson, _ := json.Marshal(columnList)
 	conf.Set(WRITE_COLUMNS, colJson)
 
+	if IsMirror(conf) {
+		// 镜像模式下每个文档都带上本次同步的版本
+		propMap[GetMirrorField(conf)] = map[string]interface{}{"type": "long"}
+	}
+	if IsExpandDottedFields(conf) {
+		if propMap, err = expandDottedProperties(propMap); err != nil {
+			return "", NewWriterError(BAD_CONFIG_VALUE, "expand dotted columns failed", err)
+		}
+	}
+
 	rootMappings := make(map[string]interface{})
 	typeMappings := make(map[string]interface{})
 	typeMappings["properties"] = propMap
@@ -406,10 +980,8 @@ func GenMappings(dstDynamic, typeName string, isGreaterOrEqualThan7 bool, conf *
 	}
 	if mappings == "" {
 		message := "must have mappings"
-		slog.Error(message)
-		os.Exit(1)
-		return ""
+		return "", NewWriterError(ES_MAPPINGS, message, nil)
 	}
 
-	return mappings
+	return mappings, nil
 }
@@ -2,6 +2,8 @@ package elasticsearch
 
 import (
 	"encoding/json"
+	"fmt"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -20,6 +22,28 @@ func GetEndpoint(conf *config.JSON) string {
 	return v
 }
 
+// GetEndpoints endpoint可以是数组，也可以是逗号分隔的多个地址
+func GetEndpoints(conf *config.JSON) []string {
+	var endpoints []string
+	arr, err := conf.GetArray("endpoint")
+	if err == nil {
+		for _, v := range arr {
+			var endpoint string
+			json.Unmarshal([]byte(v.String()), &endpoint)
+			if endpoint = strings.TrimSpace(endpoint); endpoint != "" {
+				endpoints = append(endpoints, endpoint)
+			}
+		}
+		return endpoints
+	}
+	for _, endpoint := range strings.Split(GetEndpoint(conf), ",") {
+		if endpoint = strings.TrimSpace(endpoint); endpoint != "" {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints
+}
+
 func GetUsername(conf *config.JSON) string {
 	username, _ := conf.GetString("username")
 	return username
@@ -30,11 +54,105 @@ func GetPassword(conf *config.JSON) string {
 	return pass
 }
 
+func GetCACert(conf *config.JSON) string {
+	v, _ := conf.GetString("caCert")
+	return v
+}
+
+func GetClientCert(conf *config.JSON) string {
+	v, _ := conf.GetString("clientCert")
+	return v
+}
+
+func GetClientKey(conf *config.JSON) string {
+	v, _ := conf.GetString("clientKey")
+	return v
+}
+
+func GetServerName(conf *config.JSON) string {
+	v, _ := conf.GetString("serverName")
+	return v
+}
+
+func IsInsecureSkipVerify(conf *config.JSON) bool {
+	v, err := conf.GetBool("insecureSkipVerify")
+	if err != nil {
+		return false
+	}
+	return v
+}
+
 func GetBatchSize(conf *config.JSON) int64 {
 	v, _ := conf.GetInt64("batchSize")
 	return v
 }
 
+// GetBatchSizeBytes 一个bulk请求序列化后的字节数上限，0表示不限制
+func GetBatchSizeBytes(conf *config.JSON) int64 {
+	v, _ := conf.GetInt64("batchSizeBytes")
+	return v
+}
+
+func IsAdaptiveBatchSize(conf *config.JSON) bool {
+	v, err := conf.GetBool("adaptiveBatchSize")
+	if err != nil {
+		return false
+	}
+	return v
+}
+
+// GetMinBatchSize 自适应时批量大小的下限，默认是batchSize的十分之一
+func GetMinBatchSize(conf *config.JSON) int64 {
+	v, err := conf.GetInt64("minBatchSize")
+	if v <= 0 || err != nil {
+		return max(1, GetBatchSize(conf)/10)
+	}
+	return v
+}
+
+// GetTargetLatency 自适应时bulk请求的目标延迟，单位毫秒
+func GetTargetLatency(conf *config.JSON) int64 {
+	v, err := conf.GetInt64("targetLatency")
+	if v <= 0 || err != nil {
+		return 1000
+	}
+	return v
+}
+
+// GetFlushInterval 缓冲区的刷新间隔，单位毫秒
+func GetFlushInterval(conf *config.JSON) int64 {
+	v, err := conf.GetInt64("flushInterval")
+	if v <= 0 || err != nil {
+		return 1000
+	}
+	return v
+}
+
+// GetBulkWorkers 并发提交bulk请求的worker数，关闭multiThread时只有一个
+// 有op列、update、delete或deleteBy时同一个_id的写入必须保持顺序，也只有一个
+func GetBulkWorkers(conf *config.JSON) int64 {
+	v, err := conf.GetInt64("bulkWorkers")
+	if v <= 0 || err != nil || !IsMultiThread(conf) || IsOrderSensitive(conf) {
+		return 1
+	}
+	return v
+}
+
+// IsOrderSensitive 多个worker并发时同一个_id的请求可能乱序，例如删除被更早的upsert覆盖
+func IsOrderSensitive(conf *config.JSON) bool {
+	actionType := GetActionType(conf)
+	return HasOpColumn(conf) || actionType == UPDATE || actionType == DELETE || GetDeleteBy(conf) != ""
+}
+
+// GetBulkQueueSize 等待提交的bulk请求队列长度，默认和worker数相同
+func GetBulkQueueSize(conf *config.JSON) int64 {
+	v, err := conf.GetInt64("bulkQueueSize")
+	if v <= 0 || err != nil {
+		return GetBulkWorkers(conf)
+	}
+	return v
+}
+
 func IsDiscovery(conf *config.JSON) bool {
 	v, _ := conf.GetBool("discovery")
 	return v
@@ -73,6 +191,57 @@ func IsTruncate(conf *config.JSON) bool {
 	return v
 }
 
+const (
+	MAPPING_POLICY_STRICT = "strict"
+	MAPPING_POLICY_EXTEND = "extend"
+	MAPPING_POLICY_IGNORE = "ignore"
+)
+
+// GetMappingPolicy 索引已存在时配置的mapping和索引mapping不一致的处理方式，默认ignore和之前一样只打印日志，不支持的值返回空
+func GetMappingPolicy(conf *config.JSON) string {
+	v, err := conf.GetString("mappingPolicy")
+	if v == "" || err != nil {
+		return MAPPING_POLICY_IGNORE
+	}
+	switch v {
+	case MAPPING_POLICY_STRICT, MAPPING_POLICY_EXTEND, MAPPING_POLICY_IGNORE:
+		return v
+	default:
+		return ""
+	}
+}
+
+const (
+	TRUNCATE_RECREATE        = "recreate"
+	TRUNCATE_DELETE_BY_QUERY = "deleteByQuery"
+)
+
+// GetTruncateMode 清空索引的方式，默认删除后重建，不支持的值返回空
+func GetTruncateMode(conf *config.JSON) string {
+	v, err := conf.GetString("truncateMode")
+	if v == "" || err != nil {
+		return TRUNCATE_RECREATE
+	}
+	switch v {
+	case TRUNCATE_RECREATE, TRUNCATE_DELETE_BY_QUERY:
+		return v
+	default:
+		return ""
+	}
+}
+
+// GetTruncateQuery deleteByQuery模式下只删除匹配的文档，可以是字符串或者json对象
+func GetTruncateQuery(conf *config.JSON) string {
+	if v, err := conf.GetString("truncateQuery"); err == nil {
+		return v
+	}
+	v, err := conf.GetConfig("truncateQuery")
+	if err != nil {
+		return ""
+	}
+	return v.String()
+}
+
 func IsCompression(conf *config.JSON) bool {
 	v, err := conf.GetBool("compress")
 	if err != nil {
@@ -128,8 +297,7 @@ func IsIgnoreWriteError(conf *config.JSON) bool {
 func IsIgnoreParseError(conf *config.JSON) bool {
 	v, err := conf.GetBool("ignoreParseError")
 	if err != nil {
-
-		return true
+		return false
 	}
 	return v
 }
@@ -142,6 +310,15 @@ func IsHighSpeedMode(conf *config.JSON) bool {
 	return v == "highspeed"
 }
 
+// GetForceMergeSegments highspeed模式下写入完成后force merge到的segment数，0表示不做force merge
+func GetForceMergeSegments(conf *config.JSON) int {
+	v, err := conf.GetInt64("forceMergeSegments")
+	if v < 0 || err != nil {
+		v = 0
+	}
+	return int(v)
+}
+
 func GetAlias(conf *config.JSON) string {
 	v, _ := conf.GetString("alias")
 	return v
@@ -155,6 +332,14 @@ func IsNeedCleanAlias(conf *config.JSON) bool {
 	return v == "exclusive"
 }
 
+func IsDeleteOldIndex(conf *config.JSON) bool {
+	v, err := conf.GetBool("deleteOldIndex")
+	if err != nil {
+		return false
+	}
+	return v
+}
+
 func GetSplitter(conf *config.JSON) string {
 	v, err := conf.GetString("splitter")
 	if v == "" || err != nil {
@@ -200,6 +385,47 @@ func GetUnifiedVersion(conf *config.JSON) int64 {
 	return version
 }
 
+const (
+	ARRAY_FORMAT_SPLIT = "split"
+	ARRAY_FORMAT_JSON  = "json"
+)
+
+// GetArrayFormat 数组列的输入格式，split按splitter拆分，json按json数组解析
+func GetArrayFormat(col *encoding.JSON) string {
+	v, err := col.GetString("arrayFormat")
+	if err != nil || v != ARRAY_FORMAT_JSON {
+		return ARRAY_FORMAT_SPLIT
+	}
+	return v
+}
+
+// IsExpandDottedFields 把带点的列名展开成嵌套对象，同时用于mapping和写入的数据
+func IsExpandDottedFields(conf *config.JSON) bool {
+	v, err := conf.GetBool("expandDottedFields")
+	if err != nil {
+		return false
+	}
+	return v
+}
+
+// IsMirror 镜像模式，同步结束后删除源端已经不存在的文档
+func IsMirror(conf *config.JSON) bool {
+	v, err := conf.GetBool("mirror")
+	if err != nil {
+		return false
+	}
+	return v
+}
+
+// GetMirrorField 镜像模式下记录同步版本的字段
+func GetMirrorField(conf *config.JSON) string {
+	v, err := conf.GetString("mirrorField")
+	if v == "" || err != nil {
+		return "sync_version"
+	}
+	return v
+}
+
 func GetUrlParams(conf *config.JSON) map[string]interface{} {
 	mapObj, err := conf.GetMap("urlParams")
 	newMap := make(map[string]interface{})
@@ -212,6 +438,26 @@ func GetUrlParams(conf *config.JSON) map[string]interface{} {
 	return newMap
 }
 
+// bulkUrlParams bulk请求支持的url参数
+var bulkUrlParams = []string{"pipeline", "refresh", "routing", "timeout", "wait_for_active_shards", "require_alias"}
+
+// GetBulkUrlParams 把urlParams转成字符串，不支持的参数返回错误
+func GetBulkUrlParams(conf *config.JSON) (map[string]string, error) {
+	params := make(map[string]string)
+	for k, v := range GetUrlParams(conf) {
+		if !slices.Contains(bulkUrlParams, k) {
+			message := fmt.Sprintf("urlParams %s is not supported, supported params are %v", k, bulkUrlParams)
+			return nil, NewWriterError(BAD_CONFIG_VALUE, message, nil)
+		}
+		var value interface{}
+		if raw, ok := v.(*encoding.JSON); ok {
+			json.Unmarshal([]byte(raw.String()), &value)
+		}
+		params[k] = fmt.Sprint(value)
+	}
+	return params, nil
+}
+
 func GetESVersion(conf *config.JSON) int64 {
 	v, _ := conf.GetInt64("esVersion")
 	return v
@@ -346,12 +592,51 @@ func HasPrimaryKeyInfo(conf *config.JSON) bool {
 	}
 }
 
+func HasOpColumn(conf *config.JSON) bool {
+	cols := GetColumnList(conf)
+	for _, col := range cols {
+		if OP == GetESFieldType(col.Type) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetActionMapping 操作列的取值到ActionType的映射，key统一转为大写
+func GetActionMapping(conf *config.JSON) map[string]ActionType {
+	mapObj, err := conf.GetMap("actionMapping")
+	if err != nil || len(mapObj) == 0 {
+		return map[string]ActionType{
+			"I": INDEX,
+			"U": UPDATE,
+			"D": DELETE,
+		}
+	}
+	newMap := make(map[string]ActionType)
+	for k, v := range mapObj {
+		var action string
+		json.Unmarshal([]byte(v.String()), &action)
+		newMap[strings.ToUpper(k)] = ParseActionType(action)
+	}
+	return newMap
+}
+
+// GetIncludeSettings 重建索引时从老索引复制的settings，支持analysis、index.refresh_interval这样的嵌套路径，未配置时复制全部
 func GetIncludeSettings(conf *config.JSON) []string {
 	arr, err := conf.GetArray("includeSettingKeys")
 	if len(arr) == 0 || err != nil {
-		return []string{"number_of_shards", "number_of_replicas"}
+		return nil
 	}
-	return []string{}
+	keys := make([]string, 0, len(arr))
+	for _, v := range arr {
+		var key string
+		json.Unmarshal([]byte(v.String()), &key)
+		key = strings.TrimPrefix(strings.TrimSpace(key), "index.")
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
 }
 
 func GetSleepTimeInMilliSecond(conf *config.JSON) int64 {
@@ -370,6 +655,14 @@ func GetRetryTimes(conf *config.JSON) int64 {
 	return rs
 }
 
+func IsRetryOnConflict(conf *config.JSON) bool {
+	v, err := conf.GetBool("retryOnConflict")
+	if err != nil {
+		return false
+	}
+	return v
+}
+
 func IsGreaterOrEqualThan7(conf *config.JSON, client *elastic.Client) bool {
 	esVersion := GetESVersion(conf)
 	var vint int64
@@ -0,0 +1,175 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/as-tool/as-etl-engine/common/config"
+	"github.com/olivere/elastic/v7"
+)
+
+// mappingDiff 配置的mapping和索引mapping的差异
+type mappingDiff struct {
+	// 索引中没有的字段
+	missing map[string]interface{}
+	// 类型冲突的字段，格式为 字段: 配置类型 != 索引类型
+	conflicts []string
+	// 索引的mapping，补充子字段时用来取父字段的类型
+	live map[string]interface{}
+}
+
+// syncMappings 按mappingPolicy处理已存在索引的mapping差异：
+// strict有任何差异都失败，extend补充新增字段、类型冲突时失败，ignore只打印日志
+func syncMappings(client *elastic.Client, ctx context.Context, conf *config.JSON, mappings string) (bool, error) {
+	indexName := GetIndexName(conf)
+	policy := GetMappingPolicy(conf)
+
+	typeName, properties := splitMappings(mappings)
+	result, err := client.GetMapping().Index(indexName).Do(ctx)
+	if err != nil {
+		message := fmt.Sprintf("get mappings of index %s failed", indexName)
+		return false, NewWriterError(CLUSTER_UNREACHABLE, message, err)
+	}
+	// 通过别名写入时返回的是实际索引名，取第一个索引的mapping
+	var liveProperties map[string]interface{}
+	for _, v := range result {
+		indexMappings, _ := v.(map[string]interface{})
+		liveMappings, _ := indexMappings["mappings"].(map[string]interface{})
+		if typeName != "" {
+			liveMappings, _ = liveMappings[typeName].(map[string]interface{})
+		}
+		liveProperties, _ = liveMappings["properties"].(map[string]interface{})
+		break
+	}
+
+	diff := &mappingDiff{missing: make(map[string]interface{}), live: liveProperties}
+	diffProperties("", properties, liveProperties, diff)
+	if len(diff.missing) == 0 && len(diff.conflicts) == 0 {
+		return true, nil
+	}
+	missingFields := make([]string, 0, len(diff.missing))
+	for field := range diff.missing {
+		missingFields = append(missingFields, field)
+	}
+	sort.Strings(missingFields)
+	message := fmt.Sprintf("mappings of index %s differ from column config, missing fields: %v, type conflicts: [%s]",
+		indexName, missingFields, strings.Join(diff.conflicts, ", "))
+
+	switch policy {
+	case MAPPING_POLICY_IGNORE:
+		slog.Warn(message)
+		return true, nil
+	case MAPPING_POLICY_STRICT:
+		return true, NewWriterError(ES_MAPPINGS, message, nil)
+	}
+	if len(diff.conflicts) > 0 {
+		return true, NewWriterError(ES_MAPPINGS, message, nil)
+	}
+
+	body := map[string]interface{}{"properties": diff.missing}
+	putMapping := client.PutMapping().Index(indexName)
+	if typeName != "" {
+		// 7.x之前的版本mapping外面要带上typeName
+		putMapping = putMapping.IncludeTypeName(true)
+		body = map[string]interface{}{typeName: body}
+	}
+	putResult, err := putMapping.BodyJson(body).Do(ctx)
+	if err != nil {
+		message := fmt.Sprintf("put mappings %v to index %s failed", missingFields, indexName)
+		return elastic.IsStatusCode(err, http.StatusBadRequest), NewWriterError(ES_MAPPINGS, message, err)
+	}
+	if !putResult.Acknowledged {
+		message := fmt.Sprintf("put mappings %v to index %s not acknowledged", missingFields, indexName)
+		return false, NewWriterError(ES_MAPPINGS, message, nil)
+	}
+	slog.Info(fmt.Sprintf("fields %v added to mappings of index [%s]", missingFields, indexName))
+	return true, nil
+}
+
+// splitMappings 解析GenMappings生成的mappings，7.x之前的版本返回typeName
+func splitMappings(mappings string) (string, map[string]interface{}) {
+	var root map[string]interface{}
+	json.Unmarshal([]byte(mappings), &root)
+	if properties, ok := root["properties"].(map[string]interface{}); ok {
+		return "", properties
+	}
+	for typeName, v := range root {
+		typeMappings, _ := v.(map[string]interface{})
+		properties, _ := typeMappings["properties"].(map[string]interface{})
+		return typeName, properties
+	}
+	return "", nil
+}
+
+// diffProperties 递归比较字段，object和nested的子字段用点连接路径
+func diffProperties(prefix string, properties, liveProperties map[string]interface{}, diff *mappingDiff) {
+	names := make([]string, 0, len(properties))
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		field, _ := properties[name].(map[string]interface{})
+		liveField, ok := liveProperties[name].(map[string]interface{})
+		if !ok {
+			if prefix == "" {
+				diff.missing[name] = field
+			} else {
+				// 子字段缺失时，put mapping要带上父字段的路径
+				addMissingPath(diff.missing, diff.live, prefix+name, field)
+			}
+			continue
+		}
+		fieldType, liveType := mappingType(field), mappingType(liveField)
+		// 5.x之前的string在新版本中是text或keyword
+		if fieldType == "string" && (liveType == "text" || liveType == "keyword") {
+			continue
+		}
+		if fieldType != liveType {
+			diff.conflicts = append(diff.conflicts, fmt.Sprintf("%s: %s != %s", prefix+name, fieldType, liveType))
+			continue
+		}
+		subProperties, _ := field["properties"].(map[string]interface{})
+		liveSubProperties, _ := liveField["properties"].(map[string]interface{})
+		if len(subProperties) > 0 {
+			diffProperties(prefix+name+".", subProperties, liveSubProperties, diff)
+		}
+	}
+}
+
+// mappingType 字段的类型，只有properties没有type的是object
+func mappingType(field map[string]interface{}) string {
+	if t, ok := field["type"].(string); ok {
+		return strings.ToLower(t)
+	}
+	if _, ok := field["properties"]; ok {
+		return "object"
+	}
+	return ""
+}
+
+// addMissingPath 把a.b.c形式的缺失字段转换成嵌套的properties，
+// 父字段带上索引中的类型，否则es会认为是把nested字段改成object
+func addMissingPath(missing, live map[string]interface{}, path string, field map[string]interface{}) {
+	names := strings.Split(path, ".")
+	current := missing
+	for _, name := range names[:len(names)-1] {
+		liveParent, _ := live[name].(map[string]interface{})
+		live, _ = liveParent["properties"].(map[string]interface{})
+		parent, ok := current[name].(map[string]interface{})
+		if !ok {
+			parent = map[string]interface{}{"properties": make(map[string]interface{})}
+			if t, ok := liveParent["type"]; ok {
+				parent["type"] = t
+			}
+			current[name] = parent
+		}
+		current = parent["properties"].(map[string]interface{})
+	}
+	current[names[len(names)-1]] = field
+}
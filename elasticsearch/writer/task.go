@@ -6,15 +6,19 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"net/http"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/as-tool/as-etl-engine/common/element"
 
 	"github.com/as-tool/as-etl-engine/core/plugin"
 	"github.com/as-tool/as-etl-engine/core/spi/writer"
+	"github.com/as-tool/as-etl-engine/module/transport/exchange"
 
 	"github.com/olivere/elastic/v7"
 )
@@ -26,6 +30,11 @@ type Task struct {
 	IndexName              string
 	TypeName               string
 	BatchSize              int64
+	BatchSizeBytes         int64
+	FlushInterval          int64
+	BulkWorkers            int64
+	BulkQueueSize          int64
+	AdaptiveBatchSize      bool
 	EnableRedundantColumn  bool
 	ColumnList             []EsColumn
 	CombinedIdColumn       *EsColumn
@@ -37,15 +46,28 @@ type Task struct {
 	DeleteByConditions     []map[string]interface{}
 	Client                 *elastic.Client
 	ActionType             string
+	ActionMapping          map[string]string
 	EnableWriteNull        bool
 	IsGreaterOrEqualThan7  bool
 	trySize                int64
 	tryInterval            int64
 	RetryTimes             int64
 	SleepTimeInMilliSecond int64
+	RetryOnConflict        bool
+	IgnoreWriteError       bool
+	IgnoreParseError       bool
+	Versioning             bool
+	UnifiedVersion         int64
+	Mirror                 bool
+	MirrorField            string
+	ExpandDottedFields     bool
 	UrlParams              map[string]interface{}
+	BulkUrlParams          map[string]string
 	FieldDelimiter         string
 
+	sizer                *batchSizer
+	skippedNumber        int64
+	notFoundNumber       int64
 	hasPrimaryKeyInfo    bool
 	hasEsPartitionColumn bool
 	columnSizeChecked    bool
@@ -62,12 +84,44 @@ func (t *Task) Init(ctx context.Context) (err error) {
 	t.trySize = GetTrySize(conf)
 	t.tryInterval = GetTryInterval(conf)
 	t.BatchSize = GetBatchSize(conf)
+	t.BatchSizeBytes = GetBatchSizeBytes(conf)
+	t.FlushInterval = GetFlushInterval(conf)
+	t.BulkWorkers = GetBulkWorkers(conf)
+	if workers, _ := conf.GetInt64("bulkWorkers"); workers > 1 && IsOrderSensitive(conf) {
+		slog.Warn(fmt.Sprintf("bulkWorkers %d ignored, op column, update and delete need ordered writes", workers))
+	}
+	t.BulkQueueSize = GetBulkQueueSize(conf)
+	t.AdaptiveBatchSize = IsAdaptiveBatchSize(conf)
+	if t.AdaptiveBatchSize && t.BatchSize > 0 {
+		t.sizer = newBatchSizer(GetMinBatchSize(conf), t.BatchSize, time.Duration(GetTargetLatency(conf))*time.Millisecond)
+	}
 	t.Splitter = GetSplitter(conf)
 	t.ActionType = GetActionType(conf).String()
+	t.ActionMapping = make(map[string]string)
+	for code, action := range GetActionMapping(conf) {
+		t.ActionMapping[code] = action.String()
+	}
 	t.UrlParams = GetUrlParams(conf)
+	if t.BulkUrlParams, err = GetBulkUrlParams(conf); err != nil {
+		return err
+	}
 	t.EnableWriteNull = IsEnableNullUpdate(conf)
 	t.RetryTimes = GetRetryTimes(conf)
 	t.SleepTimeInMilliSecond = GetSleepTimeInMilliSecond(conf)
+	t.RetryOnConflict = IsRetryOnConflict(conf)
+	t.IgnoreWriteError = IsIgnoreWriteError(conf)
+	t.IgnoreParseError = IsIgnoreParseError(conf)
+	t.Versioning = GetVersioning(conf)
+	t.Mirror = IsMirror(conf)
+	t.MirrorField = GetMirrorField(conf)
+	t.ExpandDottedFields = IsExpandDottedFields(conf)
+	if t.Versioning || t.Mirror {
+		t.UnifiedVersion = GetUnifiedVersion(conf)
+		slog.Info(fmt.Sprintf("Task will write documents with unified version %d", t.UnifiedVersion))
+	}
+	if t.Client, err = ES_init(conf); err != nil {
+		return err
+	}
 	t.IsGreaterOrEqualThan7 = IsGreaterOrEqualThan7(conf, t.Client)
 	t.DeleteByConditions = ParseDeleteCondition(conf)
 	t.ColumnList = GetWriteColumns(conf)
@@ -85,10 +139,9 @@ func (t *Task) Init(ctx context.Context) (err error) {
 	t.TypeList = typeList
 
 	t.PrimaryKeyInfo = GetPrimaryKeyInfo(conf)
+	t.hasPrimaryKeyInfo = HasPrimaryKeyInfo(conf)
 	t.EsPartitionColumn = GetEsPartitionColumn(conf)
 	t.ColNameToIndexMap = make(map[string]int)
-
-	t.Client = ES_init(conf)
 	return
 
 }
@@ -98,53 +151,168 @@ func (w *Task) Destroy(ctx context.Context) error {
 }
 
 func (t *Task) StartWrite(ctx context.Context, receiver plugin.RecordReceiver) (err error) {
+	recordChan := make(chan element.Record)
+	var rerr error
+	afterCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	processor := newBulkProcessor(afterCtx, cancel, t)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	// 从reader读取记录放入recordChan
+	go func() {
+		defer func() {
+			wg.Done()
+			close(recordChan)
+		}()
+		for {
+			select {
+			case <-afterCtx.Done():
+				return
+			default:
+			}
+			var record element.Record
+			record, rerr = receiver.GetFromReader()
+			if rerr != nil && rerr != exchange.ErrEmpty {
+				return
+			}
+			if rerr != exchange.ErrEmpty {
+				select {
+				case <-afterCtx.Done():
+					return
+				case recordChan <- record:
+				}
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(time.Duration(t.FlushInterval) * time.Millisecond)
+	defer ticker.Stop()
 	var writerBuffer []element.Record = make([]element.Record, 0)
-	for {
-		var record element.Record
-		record, err = receiver.GetFromReader()
+	var bufferBytes int64
+	flush := func() error {
+		bulkItems, err := t.buildBulkItems(writerBuffer)
+		writerBuffer = make([]element.Record, 0)
+		bufferBytes = 0
 		if err != nil {
-			message := fmt.Sprintf("no data,%v", err)
-			slog.Error(message)
-			break
+			return err
 		}
-		if !t.columnSizeChecked {
-			isInvalid := true
-			if t.EnableRedundantColumn {
-				// 允许重复列
-				isInvalid = len(t.ColumnList) > record.ColumnNumber()
-			} else {
-				isInvalid = len(t.ColumnList) != record.ColumnNumber()
+		for _, chunk := range splitBulkItems(bulkItems, t.currentBatchSize(), t.BatchSizeBytes) {
+			if err = processor.Add(afterCtx, chunk); err != nil {
+				return err
 			}
-			if isInvalid {
-				message := fmt.Sprintf("column number not equal error, reader column size is %d, but the writer column size is %d", record.ColumnNumber(), len(t.ColumnList))
-				return errors.New(message)
+		}
+		return nil
+	}
+	done := false
+	for !done && err == nil {
+		select {
+		case record, ok := <-recordChan:
+			if !ok {
+				done = true
+				break
+			}
+			if !t.columnSizeChecked {
+				isInvalid := true
+				if t.EnableRedundantColumn {
+					// 允许重复列
+					isInvalid = len(t.ColumnList) > record.ColumnNumber()
+				} else {
+					isInvalid = len(t.ColumnList) != record.ColumnNumber()
+				}
+				if isInvalid {
+					message := fmt.Sprintf("column number not equal error, reader column size is %d, but the writer column size is %d", record.ColumnNumber(), len(t.ColumnList))
+					err = NewWriterError(BAD_CONFIG_VALUE, message, nil)
+					break
+				}
+				// 就检查本次列数
+				t.columnSizeChecked = true
+			}
+			writerBuffer = append(writerBuffer, record)
+			bufferBytes += record.ByteSize()
+			// 记录的字节数只是估算，实际的bulk请求在flush时按序列化后的大小拆分
+			if len(writerBuffer) >= int(t.currentBatchSize()) || (t.BatchSizeBytes > 0 && bufferBytes >= t.BatchSizeBytes) {
+				err = flush()
+			}
+		// 没有达到批量大小时，按时间间隔刷新
+		case <-ticker.C:
+			if len(writerBuffer) > 0 {
+				err = flush()
 			}
-			// 就检查本次列数
-			t.columnSizeChecked = true
+		case <-afterCtx.Done():
+			done = true
 		}
-		writerBuffer = append(writerBuffer, record)
-		if len(writerBuffer) >= int(t.BatchSize) {
-			t.DoBatchInsert(writerBuffer)
-			writerBuffer = make([]element.Record, 0)
+	}
+	if err == nil && afterCtx.Err() == nil && len(writerBuffer) > 0 {
+		err = flush()
+	}
+	if err != nil {
+		cancel()
+	}
+	// 等待所有在途的bulk请求完成
+	if perr := processor.Close(); err == nil {
+		err = perr
+	}
+	cancel()
+	wg.Wait()
+
+	if skipped := atomic.LoadInt64(&t.skippedNumber); skipped > 0 {
+		slog.Info(fmt.Sprintf("%d documents skipped because of version conflict", skipped))
+		if collector := t.TaskCollector(); collector != nil {
+			collector.CollectMessage("skippedRecords", strconv.FormatInt(skipped, 10))
+		}
+	}
+	if notFound := atomic.LoadInt64(&t.notFoundNumber); notFound > 0 {
+		slog.Info(fmt.Sprintf("%d deleted documents not found", notFound))
+		if collector := t.TaskCollector(); collector != nil {
+			collector.CollectMessage("notFoundDeletes", strconv.FormatInt(notFound, 10))
 		}
 	}
-	if len(writerBuffer) > 0 {
-		t.DoBatchInsert(writerBuffer)
+
+	switch {
+	case err != nil:
+		return err
+	// 外部取消时缓冲区和队列中的数据没有写入，不能当成成功
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case rerr != nil && rerr != exchange.ErrTerminate:
+		message := fmt.Sprintf("no data,%v", rerr)
+		slog.Error(message)
+		return rerr
 	}
 	return nil
 }
 
 func (t *Task) DoBatchInsert(writerBuffer []element.Record) error {
-	bulkRequest := t.Client.Bulk()
-	ctx := context.Background()
+	bulkItems, err := t.buildBulkItems(writerBuffer)
+	if err != nil {
+		return err
+	}
+	for _, chunk := range splitBulkItems(bulkItems, t.currentBatchSize(), t.BatchSizeBytes) {
+		if err = t.doBulk(context.Background(), chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// currentBatchSize 开启自适应时使用动态调整后的批量大小
+func (t *Task) currentBatchSize() int64 {
+	if t.sizer != nil {
+		return t.sizer.Size()
+	}
+	return t.BatchSize
+}
+
+// buildBulkItems 把一批记录转换成bulk请求
+func (t *Task) buildBulkItems(writerBuffer []element.Record) ([]bulkItem, error) {
+	var bulkItems []bulkItem
 	totalNumber := len(writerBuffer)
 	dirtyDataNumber := 0
-	// TODO urlParam
 	for _, record := range writerBuffer {
 		data := make(map[string]interface{})
-		var id, parent, routing, version, columnName string
+		var id, parent, routing, version, op, columnName string
 		var column element.Column
-		var err error
+		var err, parseErr error
 		for i := 0; i < record.ColumnNumber(); i++ {
 			column, err = record.GetByIndex(i)
 			if err != nil {
@@ -163,50 +331,24 @@ func (t *Task) DoBatchInsert(writerBuffer []element.Record) error {
 			} else {
 				columnType = t.TypeList[i]
 			}
-			// 如果是json数组
-			dstArray := t.ColumnList[i].DstArray
 			columnStr, err := column.AsString()
 			if t.ColumnList[i].Array && err == nil {
-				dataList := strings.Split(columnStr, t.Splitter)
-				if columnType != DATE.String() {
-					if dstArray {
-						switch columnType {
-						case BYTE.String(), KEYWORD.String(), TEXT.String():
-							data[columnName] = dataList
-						case SHORT.String(), INTEGER.String():
-							if strings.TrimSpace(columnStr) == "" {
-								data[columnName] = nil
-							} else {
-								var intDataList []int = make([]int, 0)
-								for j := 0; j < len(dataList); j++ {
-									if strings.TrimSpace(dataList[j]) != "" {
-										v, _ := strconv.Atoi(dataList[j])
-										intDataList = append(intDataList, v)
-									}
-								}
-								data[columnName] = intDataList
-							}
-						case FLOAT.String():
-							if columnStr == "" {
-								data[columnName] = nil
-							} else {
-								var intDataList []float64 = make([]float64, 0)
-								for j := 0; j < len(dataList); j++ {
-									if strings.TrimSpace(dataList[j]) != "" {
-										v, _ := strconv.ParseFloat(dataList[j], 64)
-										intDataList = append(intDataList, v)
-									}
-								}
-								data[columnName] = intDataList
-							}
-						default:
-							data[columnName] = dataList
-						}
-					} else {
-						data[columnName] = dataList
+				if column.IsNil() {
+					if t.EnableWriteNull {
+						data[columnName] = nil
 					}
-				} else {
-					data[columnName] = dataList
+					continue
+				}
+				// 数组的每个元素使用和非数组列相同的转换
+				values, err := t.convertArrayColumn(t.ColumnList[i], columnType, columnStr)
+				if errors.Is(err, errUnsupportedType) {
+					message := fmt.Sprintf("Type error: unsupported type %s for column %s", columnType, columnName)
+					return nil, NewWriterError(UNSUPPORTED_TYPE, message, nil)
+				}
+				if err != nil {
+					parseErr = err
+				} else if values != nil || t.EnableWriteNull {
+					data[columnName] = values
 				}
 			} else {
 				// 不是数组类型
@@ -238,51 +380,74 @@ func (t *Task) DoBatchInsert(writerBuffer []element.Record) error {
 					} else {
 						version = columnStr
 					}
-				case DATE.String():
-					dateStr := getDateStr(t.ColumnList[i], column)
-					data[columnName] = dateStr
-				case KEYWORD.String(), STRING.String(), TEXT.String(), IP.String(), GEO_POINT.String(), IP_RANGE.String():
-					data[columnName] = columnStr
-				case BOOLEAN.String():
-					columnBol, _ := column.AsBool()
-					data[columnName] = columnBol
-				case BYTE.String(), BINARY.String():
-					// json序列化不支持byte类型，es支持的binary类型，必须传入base64的格式
-					data[columnName] = columnStr
-				case LONG.String(), INTEGER.String(), SHORT.String():
-					columnLong, _ := column.AsInt64()
-					data[columnName] = columnLong
-				case FLOAT.String(), DOUBLE.String():
-					columnFloat, _ := column.AsFloat64()
-					data[columnName] = columnFloat
-				case GEO_SHAPE.String(), DATE_RANGE.String(), INTEGER_RANGE.String(), FLOAT_RANGE.String(), LONG_RANGE.String(), DOUBLE_RANGE.String():
-					if columnStr == "" {
-						data[columnName] = ""
-					} else {
-						v, _ := json.Marshal(columnStr)
-						data[columnName] = v
+				case OP.String():
+					op = strings.ToUpper(strings.TrimSpace(columnStr))
+				default:
+					if column.IsNil() {
+						// 经纬度分开的列在所有列处理完后再检查
+						if t.EnableWriteNull && !isGeoPointPart(t.ColumnList[i]) {
+							data[columnName] = nil
+						}
+						continue
 					}
-				case NESTED.String(), OBJECT.String():
-					if columnStr == "" {
-						data[columnName] = ""
-					} else {
-						v, _ := json.Marshal(columnStr)
-						data[columnName] = v
+					if columnType == ALIAS.String() {
+						// alias字段不能写入
+						continue
 					}
-				default:
-					message := fmt.Sprintf("Type error: unsupported type %s for column %s", columnType, columnName)
-					return errors.New(message)
+					v, err := t.convertColumnValue(t.ColumnList[i], columnType, column)
+					if errors.Is(err, errUnsupportedType) {
+						message := fmt.Sprintf("Type error: unsupported type %s for column %s", columnType, columnName)
+						return nil, NewWriterError(UNSUPPORTED_TYPE, message, nil)
+					}
+					if err != nil {
+						parseErr = err
+						break
+					}
+					if part, ok := v.(geoPointPart); ok {
+						// 经纬度分成两列时合并到同一个geo_point字段
+						mergeGeoPointPart(data, columnName, part)
+						continue
+					}
+					if v == nil {
+						// 空值和null列一样处理，没开启写null时不能覆盖已有字段
+						if t.EnableWriteNull {
+							data[columnName] = nil
+						}
+						continue
+					}
+					data[columnName] = v
 				}
 			}
+			if parseErr != nil {
+				parseErr = fmt.Errorf("column %s: %w", columnName, parseErr)
+				break
+			}
+		}
+
+		if parseErr == nil {
+			parseErr = checkMergedGeoPoints(t.ColumnList, data, t.EnableWriteNull)
+		}
+		if parseErr == nil && t.ExpandDottedFields {
+			data, parseErr = expandDottedFields(data)
+		}
+		if parseErr != nil {
+			if err := t.handleDirtyRecord(record, parseErr); err != nil {
+				return nil, err
+			}
+			dirtyDataNumber++
+			continue
 		}
 
 		if t.hasPrimaryKeyInfo {
 			var idData []string = make([]string, 0)
 			for _, eachCol := range t.PrimaryKeyInfo.Column {
-				con := t.ColNameToIndexMap[eachCol]
+				con, err := t.getRecordColumnIndex(record, eachCol)
+				if err != nil {
+					return nil, err
+				}
 				recordColumn, err := record.GetByIndex(con)
 				if err != nil {
-					return err
+					return nil, err
 				}
 				idData = append(idData, recordColumn.String())
 			}
@@ -302,44 +467,86 @@ func (t *Task) DoBatchInsert(writerBuffer []element.Record) error {
 			routing = strings.Join(idData, "")
 		}
 
-		if t.IsDeleteRecord(record) {
-			doc := elastic.NewBulkDeleteRequest().Id(id)
-			bulkRequest = bulkRequest.Add(doc)
-		} else {
+		if t.CombinedIdColumn != nil {
+			combinedId, err := t.processIDCombineFields(record, t.CombinedIdColumn)
+			if err != nil {
+				if err := t.handleDirtyRecord(record, err); err != nil {
+					return nil, err
+				}
+				dirtyDataNumber++
+				continue
+			}
+			id = combinedId
+		}
 
-			if t.CombinedIdColumn != nil {
-				_, err := t.processIDCombineFields(record, t.CombinedIdColumn)
-				if err != nil {
-					dirtyDataNumber++
-					continue
+		// 有操作列时，按每条记录的操作类型写入
+		actionType := t.ActionType
+		if op != "" {
+			action, ok := t.ActionMapping[op]
+			if !ok {
+				message := fmt.Sprintf("unknown op value %s", op)
+				if err := t.handleDirtyRecord(record, errors.New(message)); err != nil {
+					return nil, err
+				}
+				dirtyDataNumber++
+				continue
+			}
+			actionType = action
+		}
+
+		if t.Mirror {
+			// 标记本次同步写入的文档，Job.Post时删除没有标记的文档
+			data[t.MirrorField] = t.UnifiedVersion
+		}
+
+		externalVersion, versionType, err := t.externalVersion(version)
+		hasVersion := versionType != ""
+		if err != nil {
+			if err := t.handleDirtyRecord(record, err); err != nil {
+				return nil, err
+			}
+			dirtyDataNumber++
+			continue
+		}
+
+		if t.IsDeleteRecord(record) || actionType == DELETE.String() {
+			if id == "" {
+				// 删除必须指定_id
+				message := "delete record without id"
+				if err := t.handleDirtyRecord(record, errors.New(message)); err != nil {
+					return nil, err
 				}
+				dirtyDataNumber++
+				continue
+			}
+			doc := t.newDeleteRequest(id, routing)
+			if hasVersion {
+				doc.Version(externalVersion)
+				doc.VersionType(versionType)
 			}
+			bulkItems = append(bulkItems, bulkItem{request: doc, record: record, externalVersion: hasVersion})
+		} else {
 
-			switch t.ActionType {
+			switch actionType {
 
-			case INDEX.String():
+			case INDEX.String(), CREATE.String():
 				var doc = &elastic.BulkIndexRequest{}
 				// 固定写法 参看elastic.NewBulkIndexRequest()
-				doc.OpType("index")
+				doc.OpType(strings.ToLower(actionType))
 				doc.Index(t.IndexName)
 				if !t.IsGreaterOrEqualThan7 {
 					doc.Type(t.TypeName)
 				}
-				if t.EnableWriteNull {
-					dt, err := json.Marshal(data)
-					if err != nil {
-						// TODO go允许写null的写法
-					} else {
-						doc.Doc(string(dt))
-					}
-				} else {
-					dt, err := json.Marshal(data)
-					if err != nil {
-						// TODO go允许写null的写法
-					} else {
-						doc.Doc(dt)
+				// 空值是否写入在转换列时已经处理
+				dt, err := json.Marshal(data)
+				if err != nil {
+					if err := t.handleDirtyRecord(record, err); err != nil {
+						return nil, err
 					}
+					dirtyDataNumber++
+					continue
 				}
+				doc.Doc(json.RawMessage(dt))
 				if id != "" {
 					doc.Id(id)
 				}
@@ -349,13 +556,14 @@ func (t *Task) DoBatchInsert(writerBuffer []element.Record) error {
 				if routing != "" {
 					doc.Routing(routing)
 				}
-				if version != "" {
-					v, _ := strconv.ParseInt(version, 10, 64)
-					doc.Version(v)
-					doc.VersionType("external")
+				// create只支持内部版本，不能指定external version
+				useVersion := hasVersion && actionType != CREATE.String()
+				if useVersion {
+					doc.Version(externalVersion)
+					doc.VersionType(versionType)
 				}
 
-				bulkRequest = bulkRequest.Add(doc)
+				bulkItems = append(bulkItems, bulkItem{request: doc, record: record, externalVersion: useVersion})
 
 			case UPDATE.String():
 				updateDoc := &elastic.BulkUpdateRequest{}
@@ -363,16 +571,16 @@ func (t *Task) DoBatchInsert(writerBuffer []element.Record) error {
 				if !t.IsGreaterOrEqualThan7 {
 					updateDoc.Type(t.TypeName)
 				}
-				updateArr := make(map[string]interface{})
-				updateArr["doc"] = data
-				updateArr["doc_as_upsert"] = true
-				if t.EnableWriteNull {
-					dt, _ := json.Marshal(updateArr)
-					updateDoc.Doc(dt)
-				} else {
-					dt, _ := json.Marshal(updateArr)
-					updateDoc.Doc(dt)
+				dt, err := json.Marshal(data)
+				if err != nil {
+					if err := t.handleDirtyRecord(record, err); err != nil {
+						return nil, err
+					}
+					dirtyDataNumber++
+					continue
 				}
+				updateDoc.Doc(json.RawMessage(dt))
+				updateDoc.DocAsUpsert(true)
 				if id != "" {
 					updateDoc.Id(id)
 				}
@@ -382,58 +590,442 @@ func (t *Task) DoBatchInsert(writerBuffer []element.Record) error {
 				if routing != "" {
 					updateDoc.Routing(routing)
 				}
+				// update不支持external version，统一版本只用于index和delete
 				if version != "" {
-					v, _ := strconv.ParseInt(version, 10, 64)
-					updateDoc.Version(v)
+					updateDoc.Version(externalVersion)
 				}
-				bulkRequest = bulkRequest.Add(updateDoc)
+				bulkItems = append(bulkItems, bulkItem{request: updateDoc, record: record})
+			}
+		}
+	}
+	// 计算序列化后的大小，用于按字节数拆分bulk
+	sizedItems := make([]bulkItem, 0, len(bulkItems))
+	for _, item := range bulkItems {
+		size, err := requestSize(item.request)
+		if err != nil {
+			if err := t.handleDirtyRecord(item.record, err); err != nil {
+				return nil, err
+			}
+			dirtyDataNumber++
+			continue
+		}
+		item.size = size
+		sizedItems = append(sizedItems, item)
+	}
+	if dirtyDataNumber > 0 {
+		slog.Warn(fmt.Sprintf("this batch has dirty data, dirtyDataNumber: %d totalDataNumber: %d", dirtyDataNumber,
+			totalNumber))
+	}
+	return sizedItems, nil
+}
+
+var errUnsupportedType = errors.New("unsupported type")
+
+// convertColumnValue 把非数组的数据列转换成写入es的值
+func (t *Task) convertColumnValue(esColumn EsColumn, columnType string, column element.Column) (interface{}, error) {
+	switch columnType {
+	case DATE.String():
+		return getDateStr(esColumn, column)
+	case KEYWORD.String(), STRING.String(), TEXT.String(), IP.String(), IP_RANGE.String(),
+		WILDCARD.String(), CONSTANT_KEYWORD.String(), MATCH_ONLY_TEXT.String(), SEARCH_AS_YOU_TYPE.String(),
+		VERSION_FIELD.String(), TOKEN_COUNT.String():
+		// token_count写入的是原文，由es分词后计数
+		return column.AsString()
+	case COMPLETION.String(), JOIN.String():
+		// 可以是字符串，也可以是{"input": [...], "weight": 1}或{"name": "answer", "parent": "1"}这样的json
+		columnStr, err := column.AsString()
+		if err != nil {
+			return nil, err
+		}
+		if trimmed := strings.TrimSpace(columnStr); strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+			var v interface{}
+			if err := json.Unmarshal([]byte(trimmed), &v); err != nil {
+				return nil, fmt.Errorf("column %s is not valid json: %w", esColumn.Name, err)
+			}
+			return v, nil
+		}
+		return columnStr, nil
+	case UNSIGNED_LONG.String():
+		columnStr, err := column.AsString()
+		if err != nil {
+			return nil, err
+		}
+		return strconv.ParseUint(strings.TrimSpace(columnStr), 10, 64)
+	case GEO_POINT.String():
+		return convertGeoPoint(esColumn, column)
+	case GEO_SHAPE.String():
+		return convertGeoShape(esColumn, column)
+	case BOOLEAN.String():
+		return column.AsBool()
+	case BYTE.String(), BINARY.String():
+		// json序列化不支持byte类型，es支持的binary类型，必须传入base64的格式
+		return column.AsString()
+	case LONG.String(), INTEGER.String(), SHORT.String():
+		return column.AsInt64()
+	case FLOAT.String(), DOUBLE.String(), HALF_FLOAT.String(), SCALED_FLOAT.String():
+		return column.AsFloat64()
+	case DENSE_VECTOR.String():
+		columnStr, err := column.AsString()
+		if err != nil {
+			return nil, err
+		}
+		return parseDenseVector(esColumn, columnStr, t.Splitter)
+	case SPARSE_VECTOR.String(), RANK_FEATURES.String():
+		columnStr, err := column.AsString()
+		if err != nil {
+			return nil, err
+		}
+		return parseFeatures(esColumn, columnStr)
+	case FLATTENED.String(), HISTOGRAM.String(), DATE_RANGE.String(), INTEGER_RANGE.String(), FLOAT_RANGE.String(), LONG_RANGE.String(), DOUBLE_RANGE.String(),
+		NESTED.String(), OBJECT.String():
+		columnStr, err := column.AsString()
+		if err != nil {
+			return nil, err
+		}
+		return parseJSONColumn(esColumn, columnType, columnStr)
+	default:
+		return nil, errUnsupportedType
+	}
+}
+
+// parseJSONColumn 把json字符串解析成对象或数组写入，而不是当成字符串写入
+func parseJSONColumn(esColumn EsColumn, columnType string, columnStr string) (interface{}, error) {
+	columnStr = strings.TrimSpace(columnStr)
+	if columnStr == "" {
+		return nil, nil
+	}
+	decoder := json.NewDecoder(strings.NewReader(columnStr))
+	// 保留大整数的精度
+	decoder.UseNumber()
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return nil, fmt.Errorf("column %s is not valid json: %w", esColumn.Name, err)
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("column %s is not valid json: unexpected data after top-level value", esColumn.Name)
+	}
+	switch value := v.(type) {
+	case nil:
+		return nil, nil
+	case map[string]interface{}:
+		if esColumn.JsonArray {
+			return nil, fmt.Errorf("column %s is configured as jsonArray but value is a json object", esColumn.Name)
+		}
+	case []interface{}:
+		// 范围类型和geo_shape只能是对象，object和nested可以是对象数组
+		if columnType != OBJECT.String() && columnType != NESTED.String() {
+			return nil, fmt.Errorf("column %s of type %s must be a json object", esColumn.Name, columnType)
+		}
+		for _, item := range value {
+			if _, ok := item.(map[string]interface{}); !ok {
+				return nil, fmt.Errorf("column %s must be an array of json objects", esColumn.Name)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("column %s of type %s must be a json object or array", esColumn.Name, columnType)
+	}
+	return v, nil
+}
+
+// convertArrayColumn 把数组列拆分成元素并逐个转换，arrayFormat为json时按json数组解析，否则按splitter拆分
+// dstArray为false时和之前一样保留字符串元素，不做类型转换
+func (t *Task) convertArrayColumn(esColumn EsColumn, columnType string, columnStr string) ([]interface{}, error) {
+	var elements []string
+	if esColumn.ArrayFormat == ARRAY_FORMAT_JSON {
+		if strings.TrimSpace(columnStr) == "" {
+			return nil, nil
+		}
+		decoder := json.NewDecoder(strings.NewReader(columnStr))
+		decoder.UseNumber()
+		var list []json.RawMessage
+		if err := decoder.Decode(&list); err != nil {
+			return nil, fmt.Errorf("column %s is not a json array: %w", esColumn.Name, err)
+		}
+		for _, raw := range list {
+			// 字符串元素取字符串的值，其他元素取json原文
+			var str string
+			if err := json.Unmarshal(raw, &str); err != nil {
+				str = string(raw)
+			}
+			elements = append(elements, str)
+		}
+	} else {
+		elements = strings.Split(columnStr, t.Splitter)
+	}
+	if !esColumn.DstArray {
+		values := make([]interface{}, 0, len(elements))
+		for _, element := range elements {
+			values = append(values, element)
+		}
+		return values, nil
+	}
+	if strings.TrimSpace(columnStr) == "" {
+		return nil, nil
+	}
+
+	isString := columnType == KEYWORD.String() || columnType == STRING.String() || columnType == TEXT.String()
+	values := make([]interface{}, 0, len(elements))
+	for j, element := range elements {
+		if !isString && strings.TrimSpace(element) == "" {
+			// 非字符串类型忽略空元素
+			continue
+		}
+		v, err := t.convertColumnValue(esColumn, columnType, newStringColumn(esColumn.Name, element))
+		if errors.Is(err, errUnsupportedType) {
+			return nil, err
+		}
+		if err != nil {
+			return nil, fmt.Errorf("element %d %q of column %s: %w", j, element, esColumn.Name, err)
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func newStringColumn(name, value string) element.Column {
+	return element.NewDefaultColumn(element.NewStringColumnValue(value), name, 0)
+}
+
+// bulkItem 一条bulk请求和它对应的原始记录，用于失败时的重试和脏数据统计
+type bulkItem struct {
+	request         elastic.BulkableRequest
+	record          element.Record
+	size            int64
+	externalVersion bool
+}
+
+// doBulk 提交bulk请求，可重试的失败文档以更小的bulk退避重发，其余失败文档计入脏数据
+func (t *Task) doBulk(ctx context.Context, items []bulkItem) error {
+	sleep := time.Duration(t.SleepTimeInMilliSecond) * time.Millisecond
+	maxWait := 8 * sleep
+	backoff := elastic.NewExponentialBackoff(sleep, maxWait)
+	pending := items
+	for retry := 0; len(pending) > 0; retry++ {
+		bulkRequest := t.newBulkService()
+		for _, item := range pending {
+			bulkRequest.Add(item.request)
+		}
+		response, err := ExecuteWithRetry(t.observeOperate, bulkRequest, ctx, int(t.trySize), time.Duration(t.tryInterval)*time.Millisecond)
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			message := fmt.Sprintf("bulk request of %d documents failed", len(pending))
+			return NewWriterError(ES_WRITE_REJECTED, message, err)
+		}
+		pending, err = t.handleBulkResponse(response, pending)
+		if err != nil {
+			return err
+		}
+		if len(pending) == 0 {
+			break
+		}
+		if retry >= int(t.RetryTimes) {
+			message := fmt.Sprintf("%d documents still failed after %d retries", len(pending), retry)
+			if !t.IgnoreWriteError {
+				return NewWriterError(ES_WRITE_REJECTED, message, nil)
+			}
+			slog.Error(message)
+			for _, item := range pending {
+				t.collectDirtyRecord(item.record, errors.New(message))
+			}
+			break
+		}
+		wait, ok := backoff.Next(retry)
+		if !ok {
+			// 超过上限后Next返回0，继续按上限等待，避免对繁忙的集群立即重发
+			wait = maxWait
+		}
+		slog.Warn(fmt.Sprintf("%d documents failed, retrying after %v (attempt %d/%d)", len(pending), wait.String(), retry+1, t.RetryTimes))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+	return nil
+}
+
+// handleBulkResponse 按状态对bulk返回的每个文档分类，返回需要重试的文档
+// 不可重试的失败文档在忽略写入错误时计入脏数据，否则返回错误
+func (t *Task) handleBulkResponse(response *elastic.BulkResponse, items []bulkItem) ([]bulkItem, error) {
+	var retryItems []bulkItem
+	var failedNumber int
+	var firstErr error
+	if len(response.Items) != len(items) {
+		message := fmt.Sprintf("bulk response items size %d not equal to request size %d", len(response.Items), len(items))
+		return nil, NewWriterError(ES_WRITE_REJECTED, message, nil)
+	}
+	for i, m := range response.Items {
+		for action, item := range m {
+			if item.Status >= 200 && item.Status <= 299 {
+				continue
+			}
+			if action == "delete" && item.Status == http.StatusNotFound {
+				// 要删除的文档已经不存在，cdc中很常见，当成成功
+				atomic.AddInt64(&t.notFoundNumber, 1)
+				continue
+			}
+			if t.isRetryable(action, item) {
+				retryItems = append(retryItems, items[i])
+				continue
+			}
+			if items[i].externalVersion && isVersionConflict(item) {
+				// 外部版本冲突说明es中已经是更新的数据，跳过
+				atomic.AddInt64(&t.skippedNumber, 1)
+				continue
+			}
+			reason := errorReason(item)
+			if item.Status == http.StatusConflict {
+				// create模式下文档已存在，逐条报告
+				slog.Warn(fmt.Sprintf("document conflict, index:%s, id:%s, reason:%s", item.Index, item.Id, reason))
+			} else {
+				slog.Error(fmt.Sprintf("document failed, index:%s, id:%s, status:%d, reason:%s", item.Index, item.Id, item.Status, reason))
+			}
+			err := fmt.Errorf("%s failed, index:%s, id:%s, status:%d, reason:%s", action, item.Index, item.Id, item.Status, reason)
+			if t.IgnoreWriteError {
+				t.collectDirtyRecord(items[i].record, err)
+				continue
+			}
+			failedNumber++
+			if firstErr == nil {
+				firstErr = err
 			}
 		}
 	}
-	if dirtyDataNumber >= totalNumber {
-		message := fmt.Sprintf("all this batch is dirty data, dirtyDataNumber: %d totalDataNumber: %d", dirtyDataNumber,
-			totalNumber)
-		return errors.New(message)
+	if firstErr != nil {
+		message := fmt.Sprintf("%d documents failed, first error", failedNumber)
+		return nil, NewWriterError(ES_WRITE_REJECTED, message, firstErr)
+	}
+	return retryItems, nil
+}
+
+// isRetryable 429和503是集群繁忙，更新时的版本冲突需要配置retryOnConflict才重试
+func (t *Task) isRetryable(action string, item *elastic.BulkResponseItem) bool {
+	switch item.Status {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	case http.StatusConflict:
+		return action == "update" && t.RetryOnConflict
 	}
-	ExecuteWithRetry(doOperate, bulkRequest, ctx, int(t.trySize), time.Duration(t.tryInterval))
+	return false
+}
 
+// handleDirtyRecord 忽略解析错误时记录为脏数据，否则返回错误让任务失败
+func (t *Task) handleDirtyRecord(record element.Record, err error) error {
+	if !t.IgnoreParseError {
+		message := fmt.Sprintf("parse record %v failed", record)
+		return NewWriterError(RECORD_PARSE, message, err)
+	}
+	slog.Warn(fmt.Sprintf("dirty record %v: %v", record, err))
+	t.collectDirtyRecord(record, err)
 	return nil
 }
 
+func (t *Task) collectDirtyRecord(record element.Record, err error) {
+	if collector := t.TaskCollector(); collector != nil {
+		collector.CollectDirtyRecordWithError(record, err)
+	}
+}
+
 // 重试函数，接受一个操作函数、最大重试次数以及重试间隔
-func ExecuteWithRetry(operation func(*elastic.BulkService, context.Context) (bool, error), bulkRequest *elastic.BulkService, ctx context.Context, maxRetries int, retryInterval time.Duration) (success bool, err error) {
+func ExecuteWithRetry(operation func(*elastic.BulkService, context.Context) (*elastic.BulkResponse, error), bulkRequest *elastic.BulkService, ctx context.Context, maxRetries int, retryInterval time.Duration) (response *elastic.BulkResponse, err error) {
 	for attempt := 0; attempt < maxRetries; attempt++ {
-		success, err = operation(bulkRequest, ctx)
+		response, err = operation(bulkRequest, ctx)
 		if err == nil {
 			// 操作成功，跳出循环
 			break
 		}
-		if success {
-			// 操作失败，重试不了了
-			slog.Error(fmt.Sprintf("Operation failed,%s ", err))
+		// 已经取消时不再重试，保证取消后能尽快退出
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if attempt == maxRetries-1 {
 			break
 		}
 		// 操作失败，等待一段时间后重试
 		slog.Error(fmt.Sprintf("Operation failed, retrying after %v (attempt %d/%d)\n", retryInterval.String(), attempt+1, maxRetries))
 
-		time.Sleep(retryInterval)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(retryInterval):
+		}
 	}
-	return success, err
+	return response, err
 }
 
-func doOperate(bulkRequest *elastic.BulkService, ctx context.Context) (bool, error) {
-	response, err := bulkRequest.Do(ctx)
-	if err != nil {
-		return false, err
+func (t *Task) newDeleteRequest(id, routing string) *elastic.BulkDeleteRequest {
+	doc := elastic.NewBulkDeleteRequest().Index(t.IndexName).Id(id)
+	if !t.IsGreaterOrEqualThan7 {
+		doc.Type(t.TypeName)
+	}
+	if routing != "" {
+		doc.Routing(routing)
+	}
+	return doc
+}
+
+// externalVersion 返回版本和version_type，记录的版本列优先，没有时开启versioning使用整个job统一的版本
+// 统一版本使用external_gte，同一次同步中对同一个_id的多次写入和删除不会冲突
+func (t *Task) externalVersion(version string) (int64, string, error) {
+	if version != "" {
+		v, err := strconv.ParseInt(version, 10, 64)
+		if err != nil {
+			return 0, "", err
+		}
+		return v, "external", nil
+	}
+	if t.Versioning {
+		return t.UnifiedVersion, "external_gte", nil
+	}
+	return 0, "", nil
+}
+
+// newBulkService 创建bulk请求并设置urlParams，require_alias由client的transport追加
+func (t *Task) newBulkService() *elastic.BulkService {
+	bulkRequest := t.Client.Bulk()
+	for k, v := range t.BulkUrlParams {
+		switch k {
+		case "pipeline":
+			bulkRequest.Pipeline(v)
+		case "refresh":
+			bulkRequest.Refresh(v)
+		case "routing":
+			bulkRequest.Routing(v)
+		case "timeout":
+			bulkRequest.Timeout(v)
+		case "wait_for_active_shards":
+			bulkRequest.WaitForActiveShards(v)
+		}
+	}
+	return bulkRequest
+}
+
+// observeOperate 把每次bulk请求的延迟和结果反馈给自适应批量大小
+func (t *Task) observeOperate(bulkRequest *elastic.BulkService, ctx context.Context) (*elastic.BulkResponse, error) {
+	start := time.Now()
+	response, err := doOperate(bulkRequest, ctx)
+	if t.sizer != nil {
+		t.sizer.observe(time.Since(start), response, err)
 	}
-	failed := response.Failed()
-	l := len(failed)
-	if l > 0 {
-		msg := fmt.Sprintf("Error(%d)%t", l, response.Errors)
-		// 返回true 因为数据为空了，执行不了下一次重试了
-		return true, errors.New(msg)
+	return response, err
+}
+
+// doOperate 只返回请求级别的错误，文档级别的失败由handleBulkResponse处理
+func doOperate(bulkRequest *elastic.BulkService, ctx context.Context) (*elastic.BulkResponse, error) {
+	return bulkRequest.Do(ctx)
+}
+
+func isVersionConflict(item *elastic.BulkResponseItem) bool {
+	return item.Status == http.StatusConflict && item.Error != nil && item.Error.Type == "version_conflict_engine_exception"
+}
+
+func errorReason(item *elastic.BulkResponseItem) string {
+	if item.Error == nil {
+		return ""
 	}
-	return true, nil
+	return item.Error.Type + ": " + item.Error.Reason
 }
 
 func contains(arr []string, a string) bool {
@@ -443,37 +1035,48 @@ func contains(arr []string, a string) bool {
 	return false
 }
 
-func getDateStr(esColumn EsColumn, column element.Column) string {
+func getDateStr(esColumn EsColumn, column element.Column) (string, error) {
 	if esColumn.Origin {
-		v, _ := column.AsString()
-		return v
+		return column.AsString()
 	}
 	var dtz *time.Location
 	dtz, _ = time.LoadLocation("")
 	if esColumn.Timezone != "" {
-		dtz, _ = time.LoadLocation(esColumn.Timezone)
+		var err error
+		dtz, err = time.LoadLocation(esColumn.Timezone)
+		if err != nil {
+			return "", err
+		}
 	}
 
-	if column.Type() != element.TypeTime && esColumn.Format != "" {
-		v, _ := column.AsString()
-		date, _ := time.Parse("2006/01/02 15:04:05", v)
-		date = date.In(dtz)
-		return date.Format(esColumn.Format)
-	} else if column.Type() == element.TypeTime {
-		if column.IsNil() {
-			return ""
-		} else {
-			v, _ := column.AsTime()
-			// 格式化时间，转换为本地时间
-			localTime := v.In(dtz)
-			// 转换为字符串
-			formattedTime := localTime.Format("2006-01-02T15:04:05Z")
-			return formattedTime
+	if column.IsNil() {
+		return "", nil
+	}
+	if column.Type() == element.TypeTime {
+		v, err := column.AsTime()
+		if err != nil {
+			return "", err
 		}
-	} else {
-		v, _ := column.AsString()
-		return v
+		// 转换到配置的时区后输出
+		return formatDate(v.In(dtz), esColumn.Format), nil
+	}
+	v, err := column.AsString()
+	if err != nil {
+		return "", err
+	}
+	if len(esColumn.SrcFormat) == 0 && esColumn.Format == "" {
+		// 没有配置格式时原样写入，由es解析
+		return v, nil
+	}
+	srcFormat := esColumn.SrcFormat
+	if len(srcFormat) == 0 {
+		srcFormat = defaultSrcFormats
+	}
+	date, err := parseDate(v, srcFormat, dtz)
+	if err != nil {
+		return "", err
 	}
+	return formatDate(date.In(dtz), esColumn.Format), nil
 }
 
 func (t *Task) IsDeleteRecord(record element.Record) bool {
@@ -0,0 +1,58 @@
+package elasticsearch
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// parseDenseVector 解析json数组或者splitter分隔的浮点数，配置了dims时检查维度
+func parseDenseVector(esColumn EsColumn, columnStr string, splitter string) (interface{}, error) {
+	columnStr = strings.TrimSpace(columnStr)
+	if columnStr == "" {
+		return nil, nil
+	}
+	var vector []float64
+	if strings.HasPrefix(columnStr, "[") {
+		if err := json.Unmarshal([]byte(columnStr), &vector); err != nil {
+			return nil, fmt.Errorf("column %s is not a json array of numbers: %w", esColumn.Name, err)
+		}
+	} else {
+		for _, s := range strings.Split(columnStr, splitter) {
+			v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+			if err != nil {
+				return nil, fmt.Errorf("column %s has invalid vector element %q: %w", esColumn.Name, s, err)
+			}
+			vector = append(vector, v)
+		}
+	}
+	for i, v := range vector {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("column %s has invalid vector element %d: %v", esColumn.Name, i, v)
+		}
+	}
+	if esColumn.Dims > 0 && len(vector) != esColumn.Dims {
+		return nil, fmt.Errorf("column %s has %d dimensions, expected %d", esColumn.Name, len(vector), esColumn.Dims)
+	}
+	return vector, nil
+}
+
+// parseFeatures 解析sparse_vector和rank_features的{"特征": 权重}对象，权重必须是正数
+func parseFeatures(esColumn EsColumn, columnStr string) (interface{}, error) {
+	columnStr = strings.TrimSpace(columnStr)
+	if columnStr == "" {
+		return nil, nil
+	}
+	var features map[string]float64
+	if err := json.Unmarshal([]byte(columnStr), &features); err != nil {
+		return nil, fmt.Errorf("column %s is not a json object of feature weights: %w", esColumn.Name, err)
+	}
+	for feature, weight := range features {
+		if !(weight > 0) || math.IsInf(weight, 0) {
+			return nil, fmt.Errorf("column %s feature %s has non-positive weight %v", esColumn.Name, feature, weight)
+		}
+	}
+	return features, nil
+}